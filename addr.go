@@ -28,6 +28,17 @@ func ipEmptyString(ip net.IP) string {
 	return ip.String()
 }
 
+// normalizeIP returns a copy of ip which is
+// 4 bytes long if ip is an IPv4 address
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	buff := make(net.IP, len(ip))
+	copy(buff, ip)
+	return buff
+}
+
 type StunAddr struct {
 	IP net.IP
 	Port int
@@ -45,6 +56,13 @@ func (addr *StunAddr) String() string {
 	return net.JoinHostPort(ip, strconv.Itoa(addr.Port))
 }
 
+func (addr *StunAddr) Equal(other *StunAddr) bool {
+	if addr == nil || other == nil {
+		return addr == other
+	}
+	return addr.IP.Equal(other.IP) && addr.Port == other.Port
+}
+
 func NewStunAddr(ip net.IP, port int) *StunAddr {
 	return &StunAddr {
 		IP: ip,
@@ -155,7 +173,7 @@ func (addr *StunAddr) Encode(tid []uint8) ([]byte, error) {
 		buff[1] = STUN_AF_IPV6
 		binary.BigEndian.PutUint16(buff[2:], uint16(addr.Port))
 		buff = append(buff, addr.IP...)
-		if len(buff) != 16 {
+		if len(buff) != 20 {
 			return nil, ERROR_IP_LENGTH
 		}
 		return buff, nil
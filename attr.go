@@ -3,6 +3,7 @@ package instun
 import (
 	"encoding/binary"
 	"errors"
+	"strconv"
 )
 
 var (
@@ -28,6 +29,9 @@ const (
 	STUN_ATTR_EVEN_PORT          = 0x0018
 	STUN_ATTR_REQ_TRANSPORT      = 0x0019
 	STUN_ATTR_DONT_FRAGMENT      = 0x001a
+	STUN_ATTR_MSG_INTEGRITY_SHA256 = 0x001c
+	STUN_ATTR_PASSWORD_ALGORITHM = 0x001d
+	STUN_ATTR_USERHASH           = 0x001e
 	STUN_ATTR_XOR_MAPPED_ADDR    = 0x0020
 	STUN_ATTR_RSV_TOKEN          = 0x0022
 	STUN_ATTR_PRIORITY           = 0x0024
@@ -36,6 +40,7 @@ const (
 	STUN_ATTR_RESP_PORT          = 0x0027
 
 	/* Comprehension-optional range (0x8000-0xFFFF) */
+	STUN_ATTR_PASSWORD_ALGORITHMS = 0x8002
 	STUN_ATTR_SOFTWARE           = 0x8022
 	STUN_ATTR_ALT_SERVER         = 0x8023
 	STUN_ATTR_FINGERPRINT        = 0x8028
@@ -52,6 +57,8 @@ type StunAttr struct {
 	// value objects in general(not golang) using value
 	// Note: []byte is saved as a value
 	AttrValue interface{}
+
+	off int // offset in the decoded message
 }
 
 type ChangeRequest struct {
@@ -64,6 +71,22 @@ type ErrorCode struct {
 	Msg  string
 }
 
+func (ec *ErrorCode) Error() string {
+	return "InStun: " + strconv.Itoa(int(ec.Code)) + " " + ec.Msg
+}
+
+const (
+	PASSWORD_ALGORITHM_MD5    = 0x0001
+	PASSWORD_ALGORITHM_SHA256 = 0x0002
+)
+
+// PasswordAlgorithm is the value of PASSWORD-ALGORITHM, and
+// PASSWORD-ALGORITHMS is a []*PasswordAlgorithm
+type PasswordAlgorithm struct {
+	Algorithm uint16
+	Params    []byte
+}
+
 type UnkownAttr struct {
 	Typev []uint16
 	Typec int
@@ -158,6 +181,44 @@ func DecodeStunAttr(reader *StunReader, ua *UnkownAttr, tid []uint8) (*StunAttr,
 				AttrValue: buff,
 			}, nil
 		}
+	case STUN_ATTR_MSG_INTEGRITY_SHA256: fallthrough
+	case STUN_ATTR_USERHASH:
+		// MESSAGE-INTEGRITY-SHA256 may be truncated to 16 bytes
+		if attrLen < 16 || attrLen > 32 || attrLen & 0x03 != 0 ||
+			(attrType == STUN_ATTR_USERHASH && attrLen != 32) {
+			return nil, ERROR_BAD_MESSAGE
+		}
+		buff := make([]byte, attrLen)
+		if n, e := reader.Read(buff); n != int(attrLen) || e != nil {
+			return nil, ERROR_BAD_MESSAGE
+		}
+		return &StunAttr {
+			AttrType: attrType,
+			AttrValue: buff,
+		}, nil
+	case STUN_ATTR_PASSWORD_ALGORITHM:
+		pa, err := decodePasswordAlgorithm(reader, reader.off + int64(attrLen))
+		if err != nil {
+			return nil, err
+		}
+		return &StunAttr {
+			AttrType: attrType,
+			AttrValue: pa,
+		}, nil
+	case STUN_ATTR_PASSWORD_ALGORITHMS:
+		var pas []*PasswordAlgorithm
+		end := reader.off + int64(attrLen)
+		for reader.off < end {
+			pa, err := decodePasswordAlgorithm(reader, end)
+			if err != nil {
+				return nil, err
+			}
+			pas = append(pas, pa)
+		}
+		return &StunAttr {
+			AttrType: attrType,
+			AttrValue: pas,
+		}, nil
 	case STUN_ATTR_ERR_CODE:
 		if attrLen < 4 {
 			return nil, ERROR_BAD_MESSAGE
@@ -206,13 +267,13 @@ func DecodeStunAttr(reader *StunReader, ua *UnkownAttr, tid []uint8) (*StunAttr,
 		}
 		var n uint16
 		if reader.BigEndianRead(&n) != nil {
-			return &StunAttr {
-				AttrType: attrType,
-				AttrValue: n,
-			}, nil
-		} else {
 			return nil, ERROR_BAD_MESSAGE
 		}
+		reader.Next(int(attrLen) - 2)
+		return &StunAttr {
+			AttrType: attrType,
+			AttrValue: n,
+		}, nil
 	case STUN_ATTR_LIFETIME: fallthrough
 	case STUN_ATTR_PRIORITY: fallthrough
 	case STUN_ATTR_FINGERPRINT:
@@ -299,6 +360,32 @@ func DecodeStunAttr(reader *StunReader, ua *UnkownAttr, tid []uint8) (*StunAttr,
 	return nil, nil
 }
 
+// decodePasswordAlgorithm decodes an algorithm and its parameters
+// which are padded to 4 bytes, not reading beyond end
+func decodePasswordAlgorithm(reader *StunReader, end int64) (*PasswordAlgorithm, error) {
+	var algorithm, paramLen uint16
+	if end - reader.off < 4 {
+		return nil, ERROR_BAD_MESSAGE
+	}
+	reader.BigEndianRead(&algorithm)
+	reader.BigEndianRead(&paramLen)
+	if end - reader.off < int64(paramLen) {
+		return nil, ERROR_BAD_MESSAGE
+	}
+	params := make([]byte, paramLen)
+	if n, e := reader.Read(params); n != int(paramLen) || e != nil {
+		return nil, ERROR_BAD_MESSAGE
+	}
+	for paramLen & 0x03 != 0 && reader.off < end {
+		reader.off++
+		paramLen++
+	}
+	return &PasswordAlgorithm{
+		Algorithm: algorithm,
+		Params: params,
+	}, nil
+}
+
 func (msg *StunMsg) PeekAttr(tp uint16) *StunAttr {
 	for _, attr := range msg.Attr {
 		if attr.AttrType == tp {
@@ -324,6 +411,8 @@ func NewStunAttr(attrType uint16, v interface{}) *StunAttr {
 	case []byte:
 	case *ErrorCode:
 	case *UnkownAttr:
+	case *PasswordAlgorithm:
+	case []*PasswordAlgorithm:
 	case bool:
 	case nil:
 		return nil
@@ -372,11 +461,11 @@ func (attr *StunAttr) Encode(tid []uint8, paddingByte uint8) (ret []byte, err er
 	case STUN_ATTR_CHANGE_REQ:
 		ch := attr.AttrValue.(*ChangeRequest)
 		var n uint32
-		if ch.IP { n = 1 << 2 }
-		if ch.Port { n = 1 << 1 }
+		if ch.IP { n |= 1 << 2 }
+		if ch.Port { n |= 1 << 1 }
 		binary.BigEndian.PutUint16(buf[2:], 4)
 		buff := make([]byte, 4)
-		binary.BigEndian.PutUint32(buf[4:], n)
+		binary.BigEndian.PutUint32(buff, n)
 		return append(buf, buff...), nil
 	case STUN_ATTR_USERNAME: fallthrough
 	case STUN_ATTR_REALM: fallthrough
@@ -386,10 +475,23 @@ func (attr *StunAttr) Encode(tid []uint8, paddingByte uint8) (ret []byte, err er
 		buff := []byte(str)
 		binary.BigEndian.PutUint16(buf[2:], uint16(len(buff)))
 		return append(buf, buff...), nil
-	case STUN_ATTR_MSG_INTEGRITY:
+	case STUN_ATTR_MSG_INTEGRITY: fallthrough
+	case STUN_ATTR_MSG_INTEGRITY_SHA256: fallthrough
+	case STUN_ATTR_USERHASH:
 		buff := attr.AttrValue.([]byte)
 		binary.BigEndian.PutUint16(buf[2:], uint16(len(buff)))
 		return append(buf, buff...), nil
+	case STUN_ATTR_PASSWORD_ALGORITHM:
+		buff := attr.AttrValue.(*PasswordAlgorithm).encode()
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(buff)))
+		return append(buf, buff...), nil
+	case STUN_ATTR_PASSWORD_ALGORITHMS:
+		buff := make([]byte, 0)
+		for _, pa := range attr.AttrValue.([]*PasswordAlgorithm) {
+			buff = append(buff, pa.encode()...)
+		}
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(buff)))
+		return append(buf, buff...), nil
 	case STUN_ATTR_ERR_CODE:
 		ec := attr.AttrValue.(*ErrorCode)
 		buff := make([]byte, 4)
@@ -455,5 +557,15 @@ func (attr *StunAttr) Encode(tid []uint8, paddingByte uint8) (ret []byte, err er
 	default:
 		return nil, ERROR_UNKOWN_ATTRIBUTE
 	}
-	return nil, nil
-}
\ No newline at end of file
+}
+
+func (pa *PasswordAlgorithm) encode() []byte {
+	buff := make([]byte, 4)
+	binary.BigEndian.PutUint16(buff, pa.Algorithm)
+	binary.BigEndian.PutUint16(buff[2:], uint16(len(pa.Params)))
+	buff = append(buff, pa.Params...)
+	for len(buff) & 0x03 != 0 {
+		buff = append(buff, 0)
+	}
+	return buff
+}
@@ -0,0 +1,314 @@
+package instun
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NONCE_EXPIRY = 10 * time.Minute
+	NONCE_TIME_SIZE = 8
+	NONCE_MAC_SIZE = 8
+
+	// A nonce starting with NONCE_COOKIE is followed by the base64 of
+	// the security features of RFC 8489 section 9.2
+	NONCE_COOKIE = "obMatJos2"
+	NONCE_FEATURE_PASSWORD_ALGORITHMS = 0x80
+	NONCE_FEATURE_USERNAME_ANONYMITY = 0x40
+)
+
+// LongTermKey returns the key of the long-term credential mechanism,
+// which is MD5(username ":" realm ":" password)
+func LongTermKey(username, realm, password string) []byte {
+	key := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return key[:]
+}
+
+// PasswordKey is like LongTermKey, hashing with the password
+// algorithm of RFC 8489 section 18.5
+func PasswordKey(algorithm uint16, username, realm, password string) []byte {
+	if algorithm == PASSWORD_ALGORITHM_SHA256 {
+		key := sha256.Sum256([]byte(username + ":" + realm + ":" + password))
+		return key[:]
+	}
+	return LongTermKey(username, realm, password)
+}
+
+// UserHash returns the USERHASH of username, which is
+// SHA-256(username ":" realm)
+func UserHash(username, realm string) []byte {
+	hash := sha256.Sum256([]byte(username + ":" + realm))
+	return hash[:]
+}
+
+// LongTermAuth is the server side of the long-term credential
+// mechanism of RFC 5389 section 10.2
+type LongTermAuth struct {
+	Realm string
+	// Password returns the password of username,
+	// false if there is no such a user
+	Password func(username string) (string, bool)
+	// NonceExpiry is how long a nonce stays valid before requests
+	// using it get 438 Stale Nonce, NONCE_EXPIRY if it is 0
+	NonceExpiry time.Duration
+	// Binding makes Binding requests authenticated too,
+	// otherwise only TURN requests are
+	Binding bool
+	// PasswordAlgorithms are offered to the clients in PASSWORD-ALGORITHMS,
+	// if it is empty only RFC 5389 MD5 keys are used
+	PasswordAlgorithms []*PasswordAlgorithm
+	// UserByHash returns the username whose USERHASH is userhash,
+	// requests with a USERHASH are refused if it is nil
+	UserByHash func(userhash []byte) (string, bool)
+
+	secret []byte
+	once   sync.Once // makes secret for a LongTermAuth literal
+}
+
+func NewLongTermAuth(realm string, password func(string) (string, bool)) *LongTermAuth {
+	secret := make([]byte, sha1.Size)
+	rand.Read(secret)
+	return &LongTermAuth{
+		Realm:       realm,
+		Password:    password,
+		NonceExpiry: NONCE_EXPIRY,
+		PasswordAlgorithms: []*PasswordAlgorithm{
+			{Algorithm: PASSWORD_ALGORITHM_SHA256},
+			{Algorithm: PASSWORD_ALGORITHM_MD5},
+		},
+		secret: secret,
+	}
+}
+
+// nonceSecret returns the key of the nonce macs, made at the
+// first use if auth is not made by NewLongTermAuth
+func (auth *LongTermAuth) nonceSecret() []byte {
+	auth.once.Do(func () {
+		if auth.secret == nil {
+			auth.secret = make([]byte, sha1.Size)
+			rand.Read(auth.secret)
+		}
+	})
+	return auth.secret
+}
+
+func (auth *LongTermAuth) nonceExpiry() time.Duration {
+	if auth.NonceExpiry <= 0 {
+		return NONCE_EXPIRY
+	}
+	return auth.NonceExpiry
+}
+
+// nonceMac binds a nonce to the time it was made and to the client
+func (auth *LongTermAuth) nonceMac(stamp []byte, conn net.Conn) []byte {
+	ip, _ := getConnRAddress(conn)
+	h := hmac.New(sha1.New, auth.nonceSecret())
+	h.Write(stamp)
+	h.Write(ip)
+	return h.Sum(nil)[:NONCE_MAC_SIZE]
+}
+
+// noncePrefix returns the nonce cookie with the
+// security features auth supports, if any
+func (auth *LongTermAuth) noncePrefix() string {
+	features := make([]byte, 3)
+	if len(auth.PasswordAlgorithms) > 0 {
+		features[0] |= NONCE_FEATURE_PASSWORD_ALGORITHMS
+	}
+	if auth.UserByHash != nil {
+		features[0] |= NONCE_FEATURE_USERNAME_ANONYMITY
+	}
+	if features[0] == 0 {
+		return ""
+	}
+	return NONCE_COOKIE + base64.StdEncoding.EncodeToString(features)
+}
+
+// nonce makes a stateless nonce for the client on conn,
+// it is the hex of the time and a mac of it
+func (auth *LongTermAuth) nonce(conn net.Conn) string {
+	stamp := make([]byte, NONCE_TIME_SIZE)
+	binary.BigEndian.PutUint64(stamp, uint64(time.Now().UnixNano()))
+	return auth.noncePrefix() +
+		hex.EncodeToString(append(stamp, auth.nonceMac(stamp, conn)...))
+}
+
+func (auth *LongTermAuth) validNonce(nonce string, conn net.Conn) bool {
+	prefix := auth.noncePrefix()
+	if !strings.HasPrefix(nonce, prefix) {
+		return false
+	}
+	buff, err := hex.DecodeString(nonce[len(prefix):])
+	if err != nil || len(buff) != NONCE_TIME_SIZE + NONCE_MAC_SIZE {
+		return false
+	}
+	stamp := buff[:NONCE_TIME_SIZE]
+	if !hmac.Equal(buff[NONCE_TIME_SIZE:], auth.nonceMac(stamp, conn)) {
+		return false
+	}
+	made := time.Unix(0, int64(binary.BigEndian.Uint64(stamp)))
+	return time.Since(made) < auth.nonceExpiry()
+}
+
+// challenge answers request with code, a REALM and a new NONCE
+func (auth *LongTermAuth) challenge(w ResponseWriter, request *Request,
+	code uint16, reason string) {
+	attrs := []*StunAttr{
+		NewStunAttr(STUN_ATTR_REALM, auth.Realm),
+		NewStunAttr(STUN_ATTR_NONCE, auth.nonce(request.Conn)),
+	}
+	if len(auth.PasswordAlgorithms) > 0 {
+		attrs = append(attrs, NewStunAttr(STUN_ATTR_PASSWORD_ALGORITHMS,
+			auth.PasswordAlgorithms))
+	}
+	Error(w, request, code, reason, attrs...)
+}
+
+// passwordAlgorithm returns the algorithm msg picked, which is MD5 if
+// it picked none, false if it is not one of the offered algorithms or
+// msg doesn't repeat the offer in its PASSWORD-ALGORITHMS
+func (auth *LongTermAuth) passwordAlgorithm(msg *StunMsg) (uint16, bool) {
+	pa := msg.PeekAttr(STUN_ATTR_PASSWORD_ALGORITHM)
+	pas := msg.PeekAttr(STUN_ATTR_PASSWORD_ALGORITHMS)
+	if pa == nil && pas == nil {
+		return PASSWORD_ALGORITHM_MD5, true
+	}
+	if pa == nil || pas == nil {
+		return 0, false
+	}
+
+	offer := pas.AttrValue.([]*PasswordAlgorithm)
+	if len(offer) != len(auth.PasswordAlgorithms) {
+		return 0, false
+	}
+	for i, algorithm := range auth.PasswordAlgorithms {
+		if offer[i].Algorithm != algorithm.Algorithm ||
+			!bytes.Equal(offer[i].Params, algorithm.Params) {
+			return 0, false
+		}
+	}
+	algorithm := pa.AttrValue.(*PasswordAlgorithm).Algorithm
+	for _, offered := range auth.PasswordAlgorithms {
+		if offered.Algorithm == algorithm {
+			return algorithm, true
+		}
+	}
+	return 0, false
+}
+
+// Authenticate checks the long-term credentials of request. If they
+// are missing or wrong, request is answered with an error response
+// through w and false is returned, otherwise request is set so that
+// the response is signed with the same key and integrity algorithm.
+func (auth *LongTermAuth) Authenticate(w ResponseWriter, request *Request) bool {
+	msg := request.Msg
+	mi := msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY)
+	mi256 := msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY_SHA256)
+	if mi == nil && mi256 == nil {
+		auth.challenge(w, request, 401, "Unauthorized")
+		return false
+	}
+
+	username := msg.PeekAttr(STUN_ATTR_USERNAME)
+	userhash := msg.PeekAttr(STUN_ATTR_USERHASH)
+	realm := msg.PeekAttr(STUN_ATTR_REALM)
+	nonce := msg.PeekAttr(STUN_ATTR_NONCE)
+	if (username == nil && userhash == nil) || realm == nil || nonce == nil {
+		Error(w, request, 400, "Bad Request")
+		return false
+	}
+	if !auth.validNonce(nonce.AttrValue.(string), request.Conn) {
+		auth.challenge(w, request, 438, "Stale Nonce")
+		return false
+	}
+	algorithm, ok := auth.passwordAlgorithm(msg)
+	if !ok {
+		Error(w, request, 400, "Bad Request")
+		return false
+	}
+
+	var user string
+	if username != nil {
+		user = username.AttrValue.(string)
+	} else if auth.UserByHash != nil {
+		user, ok = auth.UserByHash(userhash.AttrValue.([]byte))
+	} else {
+		ok = false
+	}
+	password, found := auth.Password(user)
+	if !ok || !found || realm.AttrValue.(string) != auth.Realm {
+		auth.challenge(w, request, 401, "Unauthorized")
+		return false
+	}
+
+	key := PasswordKey(algorithm, user, auth.Realm, password)
+	if mi256 != nil {
+		ok = msg.CheckMessageIntegritySHA256(key) == nil
+	} else {
+		ok = msg.CheckMessageIntegrity(key) == nil
+	}
+	if !ok {
+		auth.challenge(w, request, 401, "Unauthorized")
+		return false
+	}
+
+	request.ctx.key = key
+	request.ctx.sha256 = mi256 != nil
+	request.ctx.username = user
+	return true
+}
+
+// ShortTermAuth is the server side of the short-term credential
+// mechanism of RFC 5389 section 10.1, as ICE connectivity checks use it
+type ShortTermAuth struct {
+	// Password returns the password of username,
+	// false if there is no such a user
+	Password func(username string) (string, bool)
+}
+
+// Authenticate checks the short-term credentials of request, it works
+// like LongTermAuth.Authenticate but the key is the password itself
+// and there is no realm or nonce to challenge with
+func (auth *ShortTermAuth) Authenticate(w ResponseWriter, request *Request) bool {
+	msg := request.Msg
+	username := msg.PeekAttr(STUN_ATTR_USERNAME)
+	mi256 := msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY_SHA256)
+	if username == nil ||
+		(msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY) == nil && mi256 == nil) {
+		Error(w, request, 400, "Bad Request")
+		return false
+	}
+
+	user := username.AttrValue.(string)
+	password, ok := auth.Password(user)
+	if !ok {
+		Error(w, request, 401, "Unauthorized")
+		return false
+	}
+	key := []byte(password)
+	if mi256 != nil {
+		ok = msg.CheckMessageIntegritySHA256(key) == nil
+	} else {
+		ok = msg.CheckMessageIntegrity(key) == nil
+	}
+	if !ok {
+		Error(w, request, 401, "Unauthorized")
+		return false
+	}
+
+	request.ctx.key = key
+	request.ctx.sha256 = mi256 != nil
+	request.ctx.username = user
+	return true
+}
@@ -0,0 +1,357 @@
+package instun
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// startAuth serves Binding requests authenticated by stun on a loopback
+// UDP socket, and returns a socket to talk to it from
+func startAuth(t *testing.T, stun *Stun) (*net.UDPConn, *net.UDPAddr) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stun.RunUDP(udp)
+	t.Cleanup(func() { stun.Shutdown(context.Background()) })
+	return listenPeer(t), udp.LocalAddr().(*net.UDPAddr)
+}
+
+// exchange sends data to server and returns the response
+func exchange(t *testing.T, conn *net.UDPConn, server *net.UDPAddr, data []byte) *StunMsg {
+	if _, err := conn.WriteToUDP(data, server); err != nil {
+		t.Fatal(err)
+	}
+	buff, _ := readPeer(t, conn)
+	rmsg, err := DecodeStunMsg(NewStunReaderFromBytes(buff), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rmsg
+}
+
+// longTermBinding makes a Binding request with the credentials
+// given, the empty ones are left out
+func longTermBinding(username, realm, nonce string) *StunMsg {
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	for _, attr := range []*StunAttr{
+		NewStunAttr(STUN_ATTR_USERNAME, username),
+		NewStunAttr(STUN_ATTR_REALM, realm),
+		NewStunAttr(STUN_ATTR_NONCE, nonce),
+	} {
+		if attr.AttrValue.(string) != "" {
+			msg.AddAttr(attr)
+		}
+	}
+	return msg
+}
+
+func encode(t *testing.T, msg *StunMsg, key []byte) []byte {
+	data, err := msg.Encode(nil, key, false, PADDING_BYTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func newLongTermAuth() *LongTermAuth {
+	auth := NewLongTermAuth("realm", func(username string) (string, bool) {
+		return "pass", username == "user"
+	})
+	auth.Binding = true
+	return auth
+}
+
+// challenged returns the NONCE of a 401 or 438 response with code
+func challenged(t *testing.T, rmsg *StunMsg, code uint16) string {
+	assert(t, responseCode(rmsg) == code, "challenge code error!")
+	realm := rmsg.PeekAttr(STUN_ATTR_REALM)
+	nonce := rmsg.PeekAttr(STUN_ATTR_NONCE)
+	if realm == nil || nonce == nil {
+		t.Fatal("challenge without REALM or NONCE")
+	}
+	assert(t, realm.AttrValue.(string) == "realm", "challenge realm error!")
+	return nonce.AttrValue.(string)
+}
+
+func TestLongTermKey(t *testing.T) {
+	h := md5.Sum([]byte("user:realm:pass"))
+	key := LongTermKey("user", "realm", "pass")
+	assert(t, string(key) == string(h[:]), "long-term key error!")
+
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, rawTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, "user"))
+	msg.AddAttr(NewStunAttr(STUN_ATTR_REALM, "realm"))
+	rmsg, err := DecodeStunMsg(NewStunReaderFromBytes(encode(t, msg, key)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, rmsg.CheckMessageIntegrity(key) == nil, "integrity error!")
+	assert(t, rmsg.CheckMessageIntegrity([]byte("wrong")) != nil, "wrong key passed!")
+}
+
+func TestLongTermAuth(t *testing.T) {
+	conn, server := startAuth(t, &Stun{LongTerm: newLongTermAuth()})
+	key := LongTermKey("user", "realm", "pass")
+
+	// Challenged without MESSAGE-INTEGRITY
+	rmsg := exchange(t, conn, server, encode(t, longTermBinding("user", "", ""), nil))
+	nonce := challenged(t, rmsg, 401)
+	assert(t, rmsg.PeekAttr(STUN_ATTR_PASSWORD_ALGORITHMS) != nil, "no password algorithms offered!")
+
+	// Signed, and the response is signed with the same key
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("user", "realm", nonce), key))
+	assert(t, responseCode(rmsg) == 0, "authenticated request refused!")
+	assert(t, rmsg.CheckMessageIntegrity(key) == nil, "response integrity error!")
+
+	// Missing attributes
+	for _, msg := range []*StunMsg{
+		longTermBinding("", "realm", nonce),
+		longTermBinding("user", "", nonce),
+		longTermBinding("user", "realm", ""),
+	} {
+		rmsg = exchange(t, conn, server, encode(t, msg, key))
+		assert(t, responseCode(rmsg) == 400, "request without credentials!")
+	}
+
+	// Another realm, an unknown user, a wrong password
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("user", "other", nonce),
+		LongTermKey("user", "other", "pass")))
+	challenged(t, rmsg, 401)
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("nobody", "realm", nonce),
+		LongTermKey("nobody", "realm", "pass")))
+	challenged(t, rmsg, 401)
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("user", "realm", nonce),
+		LongTermKey("user", "realm", "wrong")))
+	challenged(t, rmsg, 401)
+	assert(t, rmsg.PeekAttr(STUN_ATTR_MSG_INTEGRITY) == nil, "challenge signed!")
+
+	// A made up nonce is stale
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("user", "realm", "0123"), key))
+	challenged(t, rmsg, 438)
+}
+
+func TestLongTermAuth_Literal(t *testing.T) {
+	// Without NewLongTermAuth, the nonce secret and expiry default
+	auth := &LongTermAuth{
+		Realm: "realm",
+		Password: func(username string) (string, bool) {
+			return "pass", username == "user"
+		},
+		Binding: true,
+	}
+	conn, server := startAuth(t, &Stun{LongTerm: auth})
+	key := LongTermKey("user", "realm", "pass")
+
+	rmsg := exchange(t, conn, server, encode(t, longTermBinding("user", "", ""), nil))
+	nonce := challenged(t, rmsg, 401)
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("user", "realm", nonce), key))
+	assert(t, responseCode(rmsg) == 0, "literal long-term auth refused!")
+}
+
+func TestLongTermAuth_NonceExpiry(t *testing.T) {
+	auth := newLongTermAuth()
+	auth.NonceExpiry = 50 * time.Millisecond
+	conn, server := startAuth(t, &Stun{LongTerm: auth})
+	key := LongTermKey("user", "realm", "pass")
+
+	nonce := challenged(t, exchange(t, conn, server,
+		encode(t, longTermBinding("user", "", ""), nil)), 401)
+	time.Sleep(2 * auth.NonceExpiry)
+	rmsg := exchange(t, conn, server, encode(t, longTermBinding("user", "realm", nonce), key))
+	fresh := challenged(t, rmsg, 438)
+	assert(t, fresh != nonce, "stale nonce given again!")
+
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("user", "realm", fresh), key))
+	assert(t, responseCode(rmsg) == 0, "fresh nonce refused!")
+}
+
+func TestLongTermAuth_NonceAddress(t *testing.T) {
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: secondIP(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	conn, server := startAuth(t, &Stun{LongTerm: newLongTermAuth()})
+	key := LongTermKey("user", "realm", "pass")
+
+	// The nonce is bound to the IP address it was given to
+	nonce := challenged(t, exchange(t, conn, server,
+		encode(t, longTermBinding("user", "", ""), nil)), 401)
+	rmsg := exchange(t, other, server, encode(t, longTermBinding("user", "realm", nonce), key))
+	challenged(t, rmsg, 438)
+	rmsg = exchange(t, conn, server, encode(t, longTermBinding("user", "realm", nonce), key))
+	assert(t, responseCode(rmsg) == 0, "nonce refused!")
+}
+
+func TestShortTermAuth(t *testing.T) {
+	conn, server := startAuth(t, &Stun{ShortTerm: &ShortTermAuth{
+		Password: func(username string) (string, bool) {
+			return "pass", username == "user"
+		},
+	}})
+	shortTerm := func(username string) *StunMsg {
+		msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+		if username != "" {
+			msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, username))
+		}
+		return msg
+	}
+
+	// The password is the key, and signs the response
+	rmsg := exchange(t, conn, server, encode(t, shortTerm("user"), []byte("pass")))
+	assert(t, responseCode(rmsg) == 0, "authenticated request refused!")
+	assert(t, rmsg.CheckMessageIntegrity([]byte("pass")) == nil, "response integrity error!")
+	assert(t, rmsg.PeekAttr(STUN_ATTR_XOR_MAPPED_ADDR) != nil, "binding response error!")
+
+	rmsg = exchange(t, conn, server, encode(t, shortTerm("nobody"), []byte("pass")))
+	assert(t, responseCode(rmsg) == 401, "unknown user passed!")
+	rmsg = exchange(t, conn, server, encode(t, shortTerm("user"), []byte("wrong")))
+	assert(t, responseCode(rmsg) == 401, "wrong key passed!")
+	assert(t, rmsg.PeekAttr(STUN_ATTR_MSG_INTEGRITY) == nil, "error response signed!")
+
+	// No realm or nonce to challenge with, missing credentials are a 400
+	rmsg = exchange(t, conn, server, encode(t, shortTerm(""), []byte("pass")))
+	assert(t, responseCode(rmsg) == 400, "request without USERNAME!")
+	rmsg = exchange(t, conn, server, encode(t, shortTerm("user"), nil))
+	assert(t, responseCode(rmsg) == 400, "request without MESSAGE-INTEGRITY!")
+	assert(t, rmsg.PeekAttr(STUN_ATTR_REALM) == nil && rmsg.PeekAttr(STUN_ATTR_NONCE) == nil,
+		"short-term challenge!")
+}
+
+// encodeTruncated signs msg with a MESSAGE-INTEGRITY-SHA256
+// truncated to size bytes
+func encodeTruncated(t *testing.T, msg *StunMsg, key []byte, size int) []byte {
+	data := encode(t, msg, nil)
+	binary.BigEndian.PutUint16(data[2:], uint16(len(data) - STUN_HEADER_LENGTH + 4 + size))
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	mi := NewStunAttr(STUN_ATTR_MSG_INTEGRITY_SHA256, h.Sum(nil)[:size])
+	buff, err := mi.Encode(msg.Tid[:], PADDING_BYTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(data, buff...)
+}
+
+func TestPasswordKey(t *testing.T) {
+	h := sha256.Sum256([]byte("user:realm:pass"))
+	key := PasswordKey(PASSWORD_ALGORITHM_SHA256, "user", "realm", "pass")
+	assert(t, bytes.Equal(key, h[:]), "sha-256 key error!")
+	key = PasswordKey(PASSWORD_ALGORITHM_MD5, "user", "realm", "pass")
+	assert(t, bytes.Equal(key, LongTermKey("user", "realm", "pass")), "md5 key error!")
+	h = sha256.Sum256([]byte("user:realm"))
+	assert(t, bytes.Equal(UserHash("user", "realm"), h[:]), "userhash error!")
+}
+
+func TestStunMsg_TruncatedIntegritySHA256(t *testing.T) {
+	key := []byte("key")
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, rawTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, "user"))
+	rmsg, err := DecodeStunMsg(NewStunReaderFromBytes(encodeTruncated(t, msg, key, 16)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := rmsg.PeekAttr(STUN_ATTR_MSG_INTEGRITY_SHA256)
+	assert(t, mi != nil && len(mi.AttrValue.([]byte)) == 16, "truncated mi-sha256 error!")
+	assert(t, rmsg.CheckMessageIntegritySHA256(key) == nil, "truncated mi-sha256 refused!")
+	assert(t, rmsg.CheckMessageIntegritySHA256([]byte("wrong")) != nil, "wrong key passed!")
+
+	// Shorter than 16 bytes is not allowed
+	rmsg, err = DecodeStunMsg(NewStunReaderFromBytes(encodeTruncated(t, msg, key, 12)), nil)
+	assert(t, err != nil || rmsg.PeekAttr(STUN_ATTR_MSG_INTEGRITY_SHA256) == nil,
+		"mi-sha256 of 12 bytes accepted!")
+}
+
+func TestLongTermAuth_PasswordAlgorithms(t *testing.T) {
+	auth := newLongTermAuth()
+	conn, server := startAuth(t, &Stun{LongTerm: auth})
+	rmsg := exchange(t, conn, server, encode(t, longTermBinding("user", "", ""), nil))
+	nonce := challenged(t, rmsg, 401)
+	offer := rmsg.PeekAttr(STUN_ATTR_PASSWORD_ALGORITHMS).AttrValue.([]*PasswordAlgorithm)
+	assert(t, len(offer) == 2 && offer[0].Algorithm == PASSWORD_ALGORITHM_SHA256,
+		"password algorithms offer error!")
+	key := PasswordKey(PASSWORD_ALGORITHM_SHA256, "user", "realm", "pass")
+
+	request := func(offer []*PasswordAlgorithm, algorithm uint16) *StunMsg {
+		msg := longTermBinding("user", "realm", nonce)
+		if offer != nil {
+			msg.AddAttr(NewStunAttr(STUN_ATTR_PASSWORD_ALGORITHMS, offer))
+		}
+		if algorithm != 0 {
+			msg.AddAttr(NewStunAttr(STUN_ATTR_PASSWORD_ALGORITHM,
+				&PasswordAlgorithm{Algorithm: algorithm}))
+		}
+		return msg
+	}
+
+	// SHA-256 picked from the offer echoed back, signed with both
+	// integrity algorithms, and answered with the one used
+	rmsg = exchange(t, conn, server, encode(t, request(offer, PASSWORD_ALGORITHM_SHA256), key))
+	assert(t, responseCode(rmsg) == 0, "sha-256 key refused!")
+	assert(t, rmsg.CheckMessageIntegrity(key) == nil, "response integrity error!")
+	data, _ := request(offer, PASSWORD_ALGORITHM_SHA256).EncodeSHA256(nil, key, false, PADDING_BYTE)
+	rmsg = exchange(t, conn, server, data)
+	assert(t, responseCode(rmsg) == 0, "mi-sha256 refused!")
+	assert(t, rmsg.CheckMessageIntegritySHA256(key) == nil, "response mi-sha256 error!")
+	rmsg = exchange(t, conn, server,
+		encodeTruncated(t, request(offer, PASSWORD_ALGORITHM_SHA256), key, 16))
+	assert(t, responseCode(rmsg) == 0, "truncated mi-sha256 refused!")
+
+	// The offer altered on the path is a downgrade
+	md5Only := []*PasswordAlgorithm{{Algorithm: PASSWORD_ALGORITHM_MD5}}
+	reversed := []*PasswordAlgorithm{offer[1], offer[0]}
+	md5Key := LongTermKey("user", "realm", "pass")
+	for _, msg := range []*StunMsg{
+		request(md5Only, PASSWORD_ALGORITHM_MD5),
+		request(reversed, PASSWORD_ALGORITHM_MD5),
+		request(nil, PASSWORD_ALGORITHM_MD5),
+		request(offer, 0),
+		request(offer, 0x0003),
+	} {
+		rmsg = exchange(t, conn, server, encode(t, msg, md5Key))
+		assert(t, responseCode(rmsg) == 400, "password algorithm downgrade passed!")
+	}
+
+	// MD5 without the attributes, as RFC 5389 clients do
+	rmsg = exchange(t, conn, server, encode(t, request(nil, 0), md5Key))
+	assert(t, responseCode(rmsg) == 0, "rfc 5389 client refused!")
+}
+
+func TestLongTermAuth_UserHash(t *testing.T) {
+	key := LongTermKey("user", "realm", "pass")
+	hashed := func(conn *net.UDPConn, server *net.UDPAddr, user string) *StunMsg {
+		nonce := challenged(t, exchange(t, conn, server,
+			encode(t, longTermBinding("", "", ""), nil)), 401)
+		msg := longTermBinding("", "realm", nonce)
+		msg.AddAttr(NewStunAttr(STUN_ATTR_USERHASH, UserHash(user, "realm")))
+		return msg
+	}
+
+	// Refused if the server can't look users up by hash
+	conn, server := startAuth(t, &Stun{LongTerm: newLongTermAuth()})
+	rmsg := exchange(t, conn, server, encode(t, hashed(conn, server, "user"), key))
+	challenged(t, rmsg, 401)
+
+	auth := newLongTermAuth()
+	auth.UserByHash = func(userhash []byte) (string, bool) {
+		if bytes.Equal(userhash, UserHash("user", "realm")) {
+			return "user", true
+		}
+		return "", false
+	}
+	conn, server = startAuth(t, &Stun{LongTerm: auth})
+	rmsg = exchange(t, conn, server, encode(t, hashed(conn, server, "user"), key))
+	assert(t, responseCode(rmsg) == 0, "userhash refused!")
+	assert(t, rmsg.CheckMessageIntegrity(key) == nil, "response integrity error!")
+	rmsg = exchange(t, conn, server, encode(t, hashed(conn, server, "nobody"),
+		LongTermKey("nobody", "realm", "pass")))
+	challenged(t, rmsg, 401)
+}
@@ -3,17 +3,14 @@ package instun
 import (
 	"net"
 	"crypto/tls"
-	"strings"
-	"strconv"
 )
 
 func getConnRAddress(conn net.Conn) (ip net.IP, port int) {
-	var copying = func () {
-		buff := make([]byte, len(ip))
-		copy(buff, ip)
-		ip = buff
-	}
-	defer copying() // Copy to avoid modify errors
+	// Copy to avoid modify errors, and so that an IPv4 client of
+	// a dual-stack socket gets an IPv4 address
+	defer func () {
+		ip = normalizeIP(ip)
+	} ()
 
 	switch conn.(type) {
 	case *net.TCPConn:
@@ -31,7 +28,10 @@ func getConnRAddress(conn net.Conn) (ip net.IP, port int) {
 	}
 }
 
-func getConnLAddress(conn net.Conn) (net.IP, int) {
+func getConnLAddress(conn net.Conn) (ip net.IP, port int) {
+	defer func () {
+		ip = normalizeIP(ip)
+	} ()
 	switch conn.(type) {
 	case *net.TCPConn:
 		return conn.LocalAddr().(*net.TCPAddr).IP,
@@ -48,7 +48,10 @@ func getConnLAddress(conn net.Conn) (net.IP, int) {
 	}
 }
 
-func BindingHandler(ctx *StunMsgCtx, conn net.Conn, msg *StunMsg) bool {
+// BindingHandler answers Binding requests, with the addresses
+// of the other server in stun.Config if it is running
+func (stun *Stun) BindingHandler(w ResponseWriter, request *Request) {
+	conn, msg := request.Conn, request.Msg
 
 	tid := make([]byte, STUN_TID_SIZE)
 	for i := 0; i < STUN_TID_SIZE; i++ {
@@ -56,47 +59,100 @@ func BindingHandler(ctx *StunMsgCtx, conn net.Conn, msg *StunMsg) bool {
 	}
 
 	if msg.Method() != STUN_METHOD_BINDING {
-		return false
+		return
 	}
 
 	debug("binding: request from", conn.RemoteAddr())
 
-	if ctx.ua.Typec > 0 {
-		rmsg := NewStunMsg(msg.Method(), STUN_CLASS_ERROR_RESP, msg.Tid)
-		rmsg.AddAttr(NewStunAttr(STUN_ATTR_SOFTWARE, SOFTWARE))
-		ec := &ErrorCode{
-			Code: 420,
-			Msg: "Unkown Attribute",
+	rip, rport := getConnRAddress(conn)
+	lip, lport := getConnLAddress(conn)
+	if lip.IsUnspecified() && stun.Config != nil {
+		if ip := stun.localIP(rip); ip != nil {
+			lip = ip
 		}
-		data, err := rmsg.Encode(ec, ctx.key, ctx.fp, PADDING_BYTE)
-		if err != nil {
-			return false
+	}
+
+	// Padding: the response is padded as much as the request, to
+	// test fragmentation over UDP. It would turn RESPONSE-PORT into
+	// a way to flood another port, so they can't go together.
+	padding := msg.PeekAttr(STUN_ATTR_PADDING)
+	if padding != nil {
+		if _, ok := conn.(*StunUDP); !ok || msg.PeekAttr(STUN_ATTR_RESP_PORT) != nil {
+			Error(w, request, 400, "Bad Request")
+			return
 		}
-		conn.Write(data)
-		return true
 	}
 
-	/* Doesn't support response-port just now
-	// Response-Port: change source port
-	rp := msg.PeekAttr(STUN_ATTR_RESP_PORT)
-	if rp != nil {
-		conn.Port = int(rp.AttrValue.(uint16))
+	// Response-Port: response to another port of the client IP,
+	// which makes no sense over TCP and TLS
+	if rp := msg.PeekAttr(STUN_ATTR_RESP_PORT); rp != nil {
+		udpConn, ok := conn.(*StunUDP)
+		if !ok {
+			Error(w, request, 400, "Bad Request")
+			return
+		}
+		conn = &StunUDP{
+			conn: udpConn.conn,
+			raddr: &net.UDPAddr{
+				IP:   udpConn.raddr.IP,
+				Port: int(rp.AttrValue.(uint16)),
+			},
+		}
 	}
-    */
 
+	// Change-Request: a change the server can't make is answered
+	// with a 420, rather than a response from the same address the
+	// client would take for a filtering NAT, see RFC 5780 section 6.1
 	cr := msg.PeekAttr(STUN_ATTR_CHANGE_REQ)
 	if udpConn, ok := conn.(*StunUDP); cr != nil && ok {
-		// Use communication TCP to indicate alternate server
-		// to response with alternate IP
-		if cr.AttrValue.(*ChangeRequest).IP {
-			conn = &AlternateConn{
+		change := cr.AttrValue.(*ChangeRequest)
+		if (change.IP || change.Port) && stun.Config == nil {
+			unsupportedChange(w, request)
+			return
+		}
+		if change.IP && !stun.single {
+			// Use communication TCP to indicate the other
+			// server to response with its IP, if it is up
+			if stun.otherAddress(lip, rip, lport) == nil {
+				debug("binding: other server not running for", rip)
+				unsupportedChange(w, request)
+				return
+			}
+			alter := &AlternateConn{
+				link:  stun.link,
 				rip:   udpConn.RemoteAddr().(*net.UDPAddr).IP,
 				rport: uint16(udpConn.RemoteAddr().(*net.UDPAddr).Port),
-				lport: uint16(*FlagPort),
+				lport: uint16(lport),
+				lip:   stun.otherIP(lip, rip),
 			}
-
-			if cr.AttrValue.(*ChangeRequest).Port {
-				conn.(*AlternateConn).lport = uint16(*FlagAlternatePort)
+			if change.Port {
+				alter.lport = uint16(stun.Config.otherPort(lport))
+			}
+			conn = alter
+		} else if change.IP || change.Port {
+			// Response from the local socket of the other
+			// address or port
+			ip, port := lip, lport
+			if change.IP {
+				ip = stun.otherIP(lip, rip)
+			}
+			if change.Port {
+				port = stun.Config.otherPort(lport)
+			}
+			if ip == nil {
+				debug("binding: no other address for", rip)
+				unsupportedChange(w, request)
+				return
+			}
+			other, err := stun.listenUDP(ip, port)
+			if err != nil {
+				debug("binding: no socket for", ip, port, err)
+				unsupportedChange(w, request)
+				return
+			}
+			conn = &StunUDP{
+				conn:  other,
+				raddr: udpConn.raddr,
 			}
 		}
 	}
@@ -107,33 +163,45 @@ func BindingHandler(ctx *StunMsgCtx, conn net.Conn, msg *StunMsg) bool {
 	 */
 	rmsg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_SUCCESS_RESP, msg.Tid)
 
+	// The mapped address is where the request came from,
+	// whatever RESPONSE-PORT says
 	rmsg.AddAttr(NewStunAttr(STUN_ATTR_XOR_MAPPED_ADDR,
-		NewStunAddr(getConnRAddress(conn)).Xor(tid)))
+		NewStunAddr(normalizeIP(rip), rport).Xor(tid)))
 	rmsg.AddAttr(NewStunAttr(STUN_ATTR_MAPPED_ADDR,
-		NewStunAddr(getConnRAddress(conn))))
-
-	alterIP := strings.Split(*FlagAlternateIP, ".")
-	if len(alterIP) >= 4 && comm != nil {
-		// Only alternate server is running
-		// Server can response an other address
-		ip := make(net.IP, 4)
-		for i := 0; i < 4; i++ {
-			n, _ := strconv.Atoi(alterIP[i])
-			ip[i] = uint8(n)
+		NewStunAddr(rip, rport)))
+
+	// Only if the other server is running, server can response
+	// an other address, in the same family as the client
+	if other := stun.otherAddress(lip, rip, lport); other != nil {
+		rmsg.AddAttr(NewStunAttr(STUN_ATTR_OTHER_ADDR, other))
+	}
+
+	if padding != nil {
+		rmsg.AddAttr(NewStunAttr(STUN_ATTR_PADDING,
+			make([]byte, len(padding.AttrValue.([]byte)))))
+	}
+
+	// A socket bound to any address responds from the
+	// address of the server in the config
+	origin := NewStunAddr(getConnLAddress(conn))
+	if origin.IP.IsUnspecified() && stun.Config != nil {
+		if ip := stun.localIP(rip); ip != nil {
+			origin.IP = ip
 		}
-		rmsg.AddAttr(NewStunAttr(STUN_ATTR_OTHER_ADDR,
-			NewStunAddr(ip, *FlagAlternatePort)))
 	}
+	rmsg.AddAttr(NewStunAttr(STUN_ATTR_RESP_ORIGIN, origin))
 
-	rmsg.AddAttr(NewStunAttr(STUN_ATTR_RESP_ORIGIN,
-		NewStunAddr(getConnLAddress(conn))))
-	rmsg.AddAttr(NewStunAttr(STUN_ATTR_SOFTWARE,
-		SOFTWARE))
-	if data, err := rmsg.Encode(nil, ctx.key, ctx.fp, PADDING_BYTE); err != nil {
-		return false
-	} else {
-		debug(data)
-		conn.Write(data)
+	// The link may go down meanwhile
+	if err := w.Write(rmsg, nil, conn); err == ERROR_ALTERNATE_SERVER_NOT_RUNNING {
+		unsupportedChange(w, request)
 	}
-	return true
+}
+
+// unsupportedChange answers a CHANGE-REQUEST the server can't honor
+func unsupportedChange(w ResponseWriter, request *Request) {
+	Error(w, request, 420, "Unkown Attribute",
+		NewStunAttr(STUN_ATTR_UNKNOWN_ATTR, &UnkownAttr{
+			Typec: 1,
+			Typev: []uint16{STUN_ATTR_CHANGE_REQ},
+		}))
 }
@@ -0,0 +1,246 @@
+package instun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStun_BindingResponsePort(t *testing.T) {
+	config, _, _ := startPair(t)
+	server := &net.UDPAddr{IP: config.IP, Port: config.Port}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: config.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	second, err := net.ListenUDP("udp4", &net.UDPAddr{IP: config.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	port := second.LocalAddr().(*net.UDPAddr).Port
+
+	for _, cr := range []*ChangeRequest{nil, {Port: true}, {IP: true, Port: true}} {
+		msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+		msg.AddAttr(NewStunAttr(STUN_ATTR_RESP_PORT, uint16(port)))
+		if cr != nil {
+			msg.AddAttr(NewStunAttr(STUN_ATTR_CHANGE_REQ, cr))
+		}
+		data, _ := msg.Encode(nil, nil, false, PADDING_BYTE)
+		conn.WriteTo(data, server)
+
+		// The response goes to the second socket,
+		// but maps the first one
+		buff := make([]byte, MAX_PACKET_SIZE)
+		second.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := second.ReadFrom(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rmsg, err := DecodeStunMsg(NewStunReaderFromBytes(buff[:n]), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapped := NewBindingResult(rmsg).Mapped()
+		assert(t, mapped.Port == conn.LocalAddr().(*net.UDPAddr).Port, "mapped address error!")
+	}
+}
+
+func TestStun_BindingResponsePortTCP(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&Stun{}).Run(listener)
+
+	client, err := Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.BindingTo(nil, NewStunAttr(STUN_ATTR_RESP_PORT, uint16(3478)))
+	ec, ok := err.(*ErrorCode)
+	assert(t, ok && ec.Code == 400, "RESPONSE-PORT over tcp is not rejected!")
+}
+
+func TestClient_ProbePadding(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&Stun{}).RunUDP(listener)
+
+	client, err := Dial("udp4", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+
+	// Loopback passes fragments
+	size, err := client.ProbePadding(1024, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, size == 8192, "padding probe error!")
+}
+
+// answerSmall answers Binding requests shorter than limit bytes
+// and drops the others, as a path not passing fragments would do
+func answerSmall(t *testing.T, limit int) string {
+	return fakeBinding(t, func(msg *StunMsg, size int, from *net.UDPAddr) *net.UDPAddr {
+		if size >= limit {
+			return nil
+		}
+		return from
+	}).String()
+}
+
+func TestClient_ProbePaddingLimits(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&Stun{}).RunUDP(listener)
+
+	client, err := Dial("udp4", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+
+	// max beyond the uint16 lengths is clamped
+	size, err := client.ProbePadding(8000, 1 << 20)
+	assert(t, err == nil && size == 64000, "padding max not clamped!")
+	_, err = client.ProbePadding(0, 1024)
+	assert(t, err == ERROR_PADDING_STEP, "padding step not checked!")
+
+	// The first size timing out is a path below step
+	small, err := Dial("udp4", answerSmall(t, 600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	small.RTO = 20 * time.Millisecond
+	small.Rc = 2
+	size, err = small.ProbePadding(1024, 4096)
+	assert(t, err == nil && size == 0, "padding below step error!")
+	size, err = small.ProbePadding(256, 4096)
+	assert(t, err == nil && size == 512, "padding threshold error!")
+
+	// While a server not answering at all is an error
+	silent, err := Dial("udp4", answerSmall(t, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent.RTO = 20 * time.Millisecond
+	silent.Rc = 2
+	_, err = silent.ProbePadding(256, 4096)
+	assert(t, err == ERROR_TIMEOUT, "silent server passed!")
+}
+
+func TestStun_BindingIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	go (&Stun{}).RunUDP(conn)
+	defer conn.Close()
+
+	client, err := Dial("udp6", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	result, err := client.Binding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := client.conn.LocalAddr().(*net.UDPAddr)
+	origin := conn.LocalAddr().(*net.UDPAddr)
+	assert(t, result.XorMappedAddr.Equal(NewStunAddr(net.IPv6loopback, local.Port)) &&
+		result.XorMappedAddr.IP.To4() == nil, "xor-mapped-address error!")
+	assert(t, result.ResponseOrigin.Equal(NewStunAddr(origin.IP, origin.Port)) &&
+		result.ResponseOrigin.IP.To4() == nil, "response-origin error!")
+	assert(t, result.OtherAddr == nil, "other-address of a single server!")
+}
+
+// changeRequest sends a Binding request with CHANGE-REQUEST to server
+// from conn, and returns the response
+func changeRequest(t *testing.T, conn *net.UDPConn, server net.Addr, change *ChangeRequest) *StunMsg {
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_CHANGE_REQ, change))
+	data, _ := msg.Encode(nil, nil, false, PADDING_BYTE)
+	conn.WriteTo(data, server)
+
+	buff := make([]byte, MAX_PACKET_SIZE)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmsg, err := DecodeStunMsg(NewStunReaderFromBytes(buff[:n]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rmsg
+}
+
+// isUnsupportedChange tells if rmsg is a 420 for CHANGE-REQUEST
+func isUnsupportedChange(rmsg *StunMsg) bool {
+	ec := rmsg.PeekAttr(STUN_ATTR_ERR_CODE)
+	ua := rmsg.PeekAttr(STUN_ATTR_UNKNOWN_ATTR)
+	return rmsg.Class() == STUN_CLASS_ERROR_RESP && ec != nil && ec.AttrValue.(*ErrorCode).Code == 420 &&
+		ua != nil && ua.AttrValue.(*UnkownAttr).Typec == 1 &&
+		ua.AttrValue.(*UnkownAttr).Typev[0] == STUN_ATTR_CHANGE_REQ
+}
+
+func TestStun_BindingChangeUnsupported(t *testing.T) {
+	loopback := net.IPv4(127, 0, 0, 1).To4()
+	listen := func(network string, ip net.IP) *net.UDPConn {
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Skip(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	client := listen("udp4", loopback)
+
+	// No config
+	server := listen("udp4", loopback)
+	go (&Stun{}).RunUDP(server)
+	for _, change := range []*ChangeRequest{{Port: true}, {IP: true, Port: true}} {
+		rmsg := changeRequest(t, client, server.LocalAddr(), change)
+		assert(t, isUnsupportedChange(rmsg), "change-request without config is not rejected!")
+	}
+
+	// No socket for the other port, it is taken
+	server = listen("udp4", loopback)
+	taken := listen("udp4", loopback)
+	config := NewConfig(loopback, net.IPv4(127, 0, 0, 2).To4())
+	config.Port = server.LocalAddr().(*net.UDPAddr).Port
+	config.AlternatePort = taken.LocalAddr().(*net.UDPAddr).Port
+	stun := NewStun(config)
+	if err := stun.StartSingle(); err != nil {
+		t.Fatal(err)
+	}
+	go stun.RunUDP(server)
+	rmsg := changeRequest(t, client, server.LocalAddr(), &ChangeRequest{Port: true})
+	assert(t, isUnsupportedChange(rmsg), "change-request without socket is not rejected!")
+
+	// No other address for an IPv6 client
+	server = listen("udp6", net.IPv6loopback)
+	go stun.RunUDP(server)
+	client = listen("udp6", net.IPv6loopback)
+	rmsg = changeRequest(t, client, server.LocalAddr(), &ChangeRequest{IP: true})
+	assert(t, isUnsupportedChange(rmsg), "change-request without other address is not rejected!")
+}
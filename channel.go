@@ -0,0 +1,47 @@
+package instun
+
+import (
+	"encoding/binary"
+)
+
+const (
+	CHANNEL_HEADER_LENGTH = 4
+	CHANNEL_MIN = 0x4000
+	CHANNEL_MAX = 0x7ffe
+)
+
+// IsChannelData reports whether b starts with a ChannelData
+// message, whose first two bits are 0b01 while a STUN
+// message starts with 0b00
+func IsChannelData(b []byte) bool {
+	return len(b) >= CHANNEL_HEADER_LENGTH && b[0] & 0xc0 == 0x40
+}
+
+// EncodeChannelData frames data for the channel number,
+// pad should be true over TCP and TLS
+func EncodeChannelData(number uint16, data []byte, pad bool) []byte {
+	buff := make([]byte, CHANNEL_HEADER_LENGTH, CHANNEL_HEADER_LENGTH + len(data) + 3)
+	binary.BigEndian.PutUint16(buff, number)
+	binary.BigEndian.PutUint16(buff[2:], uint16(len(data)))
+	buff = append(buff, data...)
+	if pad {
+		for len(buff) & 0x03 != 0 {
+			buff = append(buff, 0)
+		}
+	}
+	return buff
+}
+
+// DecodeChannelData returns the channel number and the
+// application data of a ChannelData message
+func DecodeChannelData(b []byte) (uint16, []byte, error) {
+	if !IsChannelData(b) {
+		return 0, nil, ERROR_BAD_MESSAGE
+	}
+	number := binary.BigEndian.Uint16(b)
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) < CHANNEL_HEADER_LENGTH + length {
+		return 0, nil, ERROR_BAD_MESSAGE
+	}
+	return number, b[CHANNEL_HEADER_LENGTH:CHANNEL_HEADER_LENGTH + length], nil
+}
@@ -0,0 +1,392 @@
+package instun
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ERROR_TIMEOUT = errors.New("InStun: transaction timeout.")
+	ERROR_CLIENT_CLOSED = errors.New("InStun: client closed.")
+	ERROR_UDP_ONLY = errors.New("InStun: only supported over udp.")
+)
+
+// Retransmission timers of RFC 5389 section 7.2
+const (
+	STUN_RTO = 500 * time.Millisecond
+	STUN_RC  = 7
+	STUN_RM  = 16
+	STUN_TI  = 39500 * time.Millisecond
+
+	// Hairpinning gives up after this, see Client.HairpinTimeout
+	HAIRPIN_TIMEOUT = 2 * time.Second
+)
+
+// Client runs STUN transactions with a server. Over UDP all requests
+// are sent from a single local socket, so that they share the same
+// NAT binding, and the responses are matched by transaction id
+// whatever address they come from.
+type Client struct {
+	// UDP: requests are retransmitted after RTO, 2*RTO, 4*RTO...
+	// and the transaction fails Rm*RTO after the Rc-th request
+	RTO time.Duration
+	Rc  int
+	Rm  int
+	// TCP and TLS: the transaction fails after Ti
+	Ti time.Duration
+	// Hairpinning: no response is the answer of a NAT which doesn't
+	// hairpin, so the test gives up after HairpinTimeout rather than
+	// Rm*RTO after the Rc-th request, which is 39.5s by default
+	HairpinTimeout time.Duration
+
+	conn   net.PacketConn // nil over TCP and TLS
+	stream net.Conn
+	server net.Addr
+
+	mutex   sync.Mutex
+	pending map[[STUN_TID_SIZE]byte]chan *clientResponse
+	handler func(data []byte, from net.Addr)
+	closed  chan struct{}
+}
+
+type clientResponse struct {
+	msg  *StunMsg
+	from net.Addr
+}
+
+// BindingResult holds the addresses of a Binding success response,
+// absent attributes are left nil
+type BindingResult struct {
+	XorMappedAddr  *StunAddr
+	MappedAddr     *StunAddr
+	ResponseOrigin *StunAddr
+	OtherAddr      *StunAddr
+}
+
+// Mapped returns XOR-MAPPED-ADDRESS,
+// or MAPPED-ADDRESS if the server is a RFC 3489 one
+func (result *BindingResult) Mapped() *StunAddr {
+	if result.XorMappedAddr != nil {
+		return result.XorMappedAddr
+	}
+	return result.MappedAddr
+}
+
+// NewClient returns a client sending datagrams to server over conn
+func NewClient(conn net.PacketConn, server net.Addr) *Client {
+	client := newClient(server)
+	client.conn = conn
+	go client.readLoop()
+	return client
+}
+
+// NewStreamClient returns a client over a TCP or TLS connection
+func NewStreamClient(conn net.Conn) *Client {
+	client := newClient(conn.RemoteAddr())
+	client.stream = conn
+	go client.readLoop()
+	return client
+}
+
+func newClient(server net.Addr) *Client {
+	return &Client{
+		RTO:     STUN_RTO,
+		Rc:      STUN_RC,
+		Rm:      STUN_RM,
+		Ti:      STUN_TI,
+		server:  server,
+		pending: make(map[[STUN_TID_SIZE]byte]chan *clientResponse),
+		closed:  make(chan struct{}),
+
+		HairpinTimeout: HAIRPIN_TIMEOUT,
+	}
+}
+
+// Dial connects to the server at address, network is one of
+// "udp", "udp4", "udp6", "tcp", "tcp4" and "tcp6"
+func Dial(network, address string) (*Client, error) {
+	if strings.HasPrefix(network, "tcp") {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return NewStreamClient(conn), nil
+	}
+
+	server, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, server), nil
+}
+
+// DialTLS connects to the server at address over TLS
+func DialTLS(network, address string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamClient(conn), nil
+}
+
+func (client *Client) Close() error {
+	client.mutex.Lock()
+	select {
+	case <-client.closed:
+		client.mutex.Unlock()
+		return nil
+	default:
+		close(client.closed)
+	}
+	client.mutex.Unlock()
+
+	if client.stream != nil {
+		return client.stream.Close()
+	}
+	return client.conn.Close()
+}
+
+func (client *Client) LocalAddr() net.Addr {
+	if client.stream != nil {
+		return client.stream.LocalAddr()
+	}
+	return client.conn.LocalAddr()
+}
+
+func (client *Client) Server() net.Addr {
+	return client.server
+}
+
+// NewTid returns a random transaction id
+func NewTid() (tid [STUN_TID_SIZE]byte) {
+	rand.Read(tid[:])
+	return
+}
+
+func (client *Client) readLoop() {
+	buff := make([]byte, MAX_PACKET_SIZE)
+	var stream *streamReader
+	if client.stream != nil {
+		stream = newStreamReader(client.stream)
+	}
+	for {
+		var data []byte
+		var from net.Addr
+		var err error
+		if stream != nil {
+			data, err = stream.next()
+			from = client.server
+		} else {
+			var n int
+			if n, from, err = client.conn.ReadFrom(buff); err == nil {
+				data = make([]byte, n)
+				copy(data, buff[:n])
+			}
+		}
+		if err != nil {
+			client.Close()
+			return
+		}
+
+		if IsChannelData(data) {
+			client.dispatch(data, from)
+			continue
+		}
+		if len(data) < STUN_HEADER_LENGTH {
+			continue
+		}
+		msg, err := DecodeStunMsg(NewStunReaderFromBytes(data), nil)
+		if err != nil {
+			continue
+		}
+		if msg.PeekAttr(STUN_ATTR_FINGERPRINT) != nil && msg.CheckFingerprint() != nil {
+			continue
+		}
+
+		client.mutex.Lock()
+		ch, ok := client.pending[msg.Tid]
+		if ok {
+			delete(client.pending, msg.Tid)
+		}
+		client.mutex.Unlock()
+		if ok {
+			ch <- &clientResponse{msg: msg, from: from}
+		} else {
+			client.dispatch(data, from)
+		}
+	}
+}
+
+// SetHandler sets the function called with what the client receives
+// besides the responses of its own transactions, such as indications,
+// ChannelData or requests from other hosts
+func (client *Client) SetHandler(handler func(data []byte, from net.Addr)) {
+	client.mutex.Lock()
+	client.handler = handler
+	client.mutex.Unlock()
+}
+
+func (client *Client) dispatch(data []byte, from net.Addr) {
+	client.mutex.Lock()
+	handler := client.handler
+	client.mutex.Unlock()
+	if handler != nil {
+		handler(data, from)
+	}
+}
+
+// timeouts returns how long to wait after each transmission
+func (client *Client) timeouts() []time.Duration {
+	if client.stream != nil {
+		return []time.Duration{client.Ti}
+	}
+	// At least one request is sent
+	rc := client.Rc
+	if rc < 1 {
+		rc = 1
+	}
+	waits := make([]time.Duration, rc)
+	rto := client.RTO
+	for i := 0; i < rc-1; i++ {
+		waits[i] = rto
+		rto *= 2
+	}
+	waits[rc-1] = time.Duration(client.Rm) * client.RTO
+	return waits
+}
+
+// timeoutsWithin returns the timeouts, cut so that
+// the transaction fails after d at most
+func (client *Client) timeoutsWithin(d time.Duration) []time.Duration {
+	var waits []time.Duration
+	for _, wait := range client.timeouts() {
+		if wait >= d {
+			return append(waits, d)
+		}
+		waits = append(waits, wait)
+		d -= wait
+	}
+	return waits
+}
+
+func (client *Client) write(data []byte, to net.Addr) error {
+	if client.stream != nil {
+		_, err := client.stream.Write(data)
+		return err
+	}
+	if to == nil {
+		to = client.server
+	}
+	_, err := client.conn.WriteTo(data, to)
+	return err
+}
+
+// Request sends msg to the address to, or to the server if to is nil,
+// and waits for the response carrying the same transaction id.
+// The response may come from any address, which is returned as well.
+// Over TCP and TLS to is ignored.
+func (client *Client) Request(msg *StunMsg, to net.Addr) (*StunMsg, net.Addr, error) {
+	return client.transaction(msg, nil, to)
+}
+
+// transaction is like Request, but adds a MESSAGE-INTEGRITY
+// made with key if key is not nil
+func (client *Client) transaction(msg *StunMsg, key []byte, to net.Addr) (*StunMsg, net.Addr, error) {
+	return client.transactionVia(client, msg, key, to, client.timeouts())
+}
+
+// transactionVia is like transaction, but msg is sent from the
+// socket of sender, while the response is waited for on the client,
+// and it is sent again after each of waits
+func (client *Client) transactionVia(sender *Client, msg *StunMsg, key []byte, to net.Addr,
+	waits []time.Duration) (*StunMsg, net.Addr, error) {
+	data, err := msg.Encode(nil, key, false, PADDING_BYTE)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan *clientResponse, 1)
+	client.mutex.Lock()
+	client.pending[msg.Tid] = ch
+	client.mutex.Unlock()
+	defer func() {
+		client.mutex.Lock()
+		delete(client.pending, msg.Tid)
+		client.mutex.Unlock()
+	}()
+
+	for _, wait := range waits {
+		if err := sender.write(data, to); err != nil {
+			return nil, nil, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case resp := <-ch:
+			timer.Stop()
+			return resp.msg, resp.from, nil
+		case <-client.closed:
+			timer.Stop()
+			return nil, nil, ERROR_CLIENT_CLOSED
+		case <-timer.C:
+		}
+	}
+	return nil, nil, ERROR_TIMEOUT
+}
+
+// Binding runs a Binding transaction with the server
+func (client *Client) Binding() (*BindingResult, error) {
+	return client.BindingTo(nil)
+}
+
+// BindingTo sends a Binding request carrying attrs to the address to,
+// or to the server if to is nil
+func (client *Client) BindingTo(to net.Addr, attrs ...*StunAttr) (*BindingResult, error) {
+	return client.bindingVia(client, to, attrs...)
+}
+
+// bindingVia is like BindingTo, but the request is sent from the
+// socket of sender, see transactionVia
+func (client *Client) bindingVia(sender *Client, to net.Addr, attrs ...*StunAttr) (*BindingResult, error) {
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	for _, attr := range attrs {
+		msg.AddAttr(attr)
+	}
+	msg.AddAttr(NewStunAttr(STUN_ATTR_SOFTWARE, SOFTWARE))
+
+	rmsg, _, err := client.transactionVia(sender, msg, nil, to, client.timeouts())
+	if err != nil {
+		return nil, err
+	}
+	if rmsg.Class() == STUN_CLASS_ERROR_RESP {
+		if ec := rmsg.PeekAttr(STUN_ATTR_ERR_CODE); ec != nil {
+			return nil, ec.AttrValue.(*ErrorCode)
+		}
+		return nil, ERROR_BAD_MESSAGE
+	}
+	return NewBindingResult(rmsg), nil
+}
+
+// NewBindingResult picks the addresses out of a Binding response
+func NewBindingResult(msg *StunMsg) *BindingResult {
+	result := &BindingResult{}
+	var peek = func(tp uint16) *StunAddr {
+		if attr := msg.PeekAttr(tp); attr != nil {
+			return attr.AttrValue.(*StunAddr)
+		}
+		return nil
+	}
+	result.XorMappedAddr = peek(STUN_ATTR_XOR_MAPPED_ADDR)
+	result.MappedAddr = peek(STUN_ATTR_MAPPED_ADDR)
+	result.ResponseOrigin = peek(STUN_ATTR_RESP_ORIGIN)
+	result.OtherAddr = peek(STUN_ATTR_OTHER_ADDR)
+	return result
+}
@@ -0,0 +1,178 @@
+package instun
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBinding answers Binding requests on loopback with the
+// XOR-MAPPED-ADDRESS of their source. answer is called with each
+// request and its size, and returns where the response goes,
+// nil drops the request.
+func fakeBinding(t *testing.T, answer func(msg *StunMsg, size int, from *net.UDPAddr) *net.UDPAddr) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func () {
+		buff := make([]byte, MAX_PACKET_SIZE)
+		for {
+			n, from, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			msg, err := DecodeStunMsg(NewStunReaderFromBytes(buff[:n]), nil)
+			if err != nil {
+				continue
+			}
+			to := answer(msg, n, from)
+			if to == nil {
+				continue
+			}
+			rmsg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_SUCCESS_RESP, msg.Tid)
+			rmsg.AddAttr(NewStunAttr(STUN_ATTR_XOR_MAPPED_ADDR,
+				NewStunAddr(normalizeIP(from.IP), from.Port).Xor(msg.Tid[:])))
+			if data, err := rmsg.Encode(nil, nil, false, PADDING_BYTE); err == nil {
+				conn.WriteToUDP(data, to)
+			}
+		}
+	} ()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestClient_Timeouts(t *testing.T) {
+	ms := time.Millisecond
+	stream := &net.TCPConn{}
+	cases := []struct {
+		client *Client
+		waits  []time.Duration
+	}{
+		// RFC 5389 section 7.2.1: 0, 500, 1500, 3500, 7500, 15500
+		// and 31500 ms, failed at 39500 ms
+		{newClient(nil), []time.Duration{500 * ms, 1000 * ms, 2000 * ms,
+			4000 * ms, 8000 * ms, 16000 * ms, 8000 * ms}},
+		{&Client{RTO: 100 * ms, Rc: 3, Rm: 4}, []time.Duration{100 * ms, 200 * ms, 400 * ms}},
+		{&Client{RTO: 100 * ms, Rc: 1, Rm: 2}, []time.Duration{200 * ms}},
+		{&Client{RTO: 100 * ms, Rc: 0, Rm: 2}, []time.Duration{200 * ms}},
+		// Reliable transports send once and wait Ti
+		{&Client{Ti: STUN_TI, stream: stream}, []time.Duration{39500 * ms}},
+		{&Client{RTO: 100 * ms, Rc: 3, Rm: 4, Ti: time.Second, stream: stream}, []time.Duration{time.Second}},
+	}
+
+	for i, c := range cases {
+		waits := c.client.timeouts()
+		if len(waits) != len(c.waits) {
+			t.Fatalf("case %d: %v, want %v", i, waits, c.waits)
+		}
+		var total time.Duration
+		for j := range waits {
+			assert(t, waits[j] == c.waits[j], "retransmission timer error!")
+			total += waits[j]
+		}
+		if i == 0 {
+			assert(t, total == STUN_TI, "transaction timeout error!")
+		}
+	}
+
+	// cut at a timeout
+	waits := newClient(nil).timeoutsWithin(2 * time.Second)
+	assert(t, len(waits) == 3 && waits[0] == 500*ms && waits[1] == 1000*ms && waits[2] == 500*ms,
+		"retransmission timer within a timeout error!")
+}
+
+func TestClient_Retransmission(t *testing.T) {
+	// A peer dropping the first two requests
+	var mutex sync.Mutex
+	var tids [][STUN_TID_SIZE]byte
+	server := fakeBinding(t, func(msg *StunMsg, size int, from *net.UDPAddr) *net.UDPAddr {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if tids = append(tids, msg.Tid); len(tids) <= 2 {
+			return nil
+		}
+		return from
+	})
+	client, err := Dial("udp4", server.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 20 * time.Millisecond
+
+	// Answered after 20 and 40 ms, by the third transmission
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	start := time.Now()
+	rmsg, _, err := client.Request(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, time.Since(start) >= 60 * time.Millisecond, "retransmitted too early!")
+	assert(t, rmsg.Tid == msg.Tid, "response of another transaction!")
+	mutex.Lock()
+	assert(t, len(tids) == 3, "retransmission count error!")
+	for _, tid := range tids {
+		assert(t, tid == msg.Tid, "retransmission with another tid!")
+	}
+	mutex.Unlock()
+
+	// Rc 0 still sends once
+	silent, err := Dial("udp4", fakeBinding(t, func(*StunMsg, int, *net.UDPAddr) *net.UDPAddr {
+		return nil
+	}).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	silent.RTO = 10 * time.Millisecond
+	silent.Rc = 0
+	silent.Rm = 2
+	_, err = silent.Binding()
+	assert(t, err == ERROR_TIMEOUT, "transaction without Rc error!")
+}
+
+func TestClient_RetransmissionTCP(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// A server reading requests without answering
+	received := make(chan int, 1)
+	go func () {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := newStreamReader(conn)
+		count := 0
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			if _, err := reader.next(); err != nil {
+				break
+			}
+			count++
+		}
+		received <- count
+	} ()
+
+	client, err := Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 10 * time.Millisecond
+	client.Ti = 200 * time.Millisecond
+
+	// Sent once, and failed after Ti rather than the UDP schedule
+	start := time.Now()
+	_, err = client.Binding()
+	elapsed := time.Since(start)
+	assert(t, err == ERROR_TIMEOUT, "tcp transaction error!")
+	assert(t, elapsed >= client.Ti && elapsed < 2 * client.Ti, "tcp timeout is not Ti!")
+	assert(t, <-received == 1, "request retransmitted over tcp!")
+}
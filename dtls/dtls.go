@@ -0,0 +1,87 @@
+//go:build dtls
+// +build dtls
+
+// dtls.go
+// This file describe STUN over DTLS (RFC 7350), with the DTLS of
+// github.com/pion/dtls. It is set up with a tls.Config as TLS is.
+// A DTLS connection carries a message per datagram, without the
+// framing of TCP and TLS. It is only built with the dtls tag, so
+// that instun itself doesn't depend on pion:
+//
+//	go build -tags dtls
+//
+package dtls
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/inszva/instun"
+	piondtls "github.com/pion/dtls/v3"
+)
+
+var (
+	ERROR_PEER = errors.New("InStun: DTLS only talks to its peer.")
+)
+
+// dtlsConfig takes the certificates and the verification of config
+func dtlsConfig(config *tls.Config) *piondtls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	return &piondtls.Config{
+		Certificates:         config.Certificates,
+		ClientAuth:           piondtls.ClientAuthType(config.ClientAuth),
+		ClientCAs:            config.ClientCAs,
+		RootCAs:              config.RootCAs,
+		ServerName:           config.ServerName,
+		InsecureSkipVerify:   config.InsecureSkipVerify,
+		ExtendedMasterSecret: piondtls.RequireExtendedMasterSecret,
+	}
+}
+
+// Listen listens for DTLS connections on the UDP address,
+// which Stun.Serve serves as the connections of a TLS listener
+func Listen(network, address string, config *tls.Config) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return piondtls.Listen(network, laddr, dtlsConfig(config))
+}
+
+// Dial connects to the server at address over DTLS, requests
+// are retransmitted as they are over UDP
+func Dial(network, address string, config *tls.Config) (*instun.Client, error) {
+	raddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := piondtls.Dial(network, raddr, dtlsConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return instun.NewClient(&datagramConn{conn}, conn.RemoteAddr()), nil
+}
+
+// datagramConn makes a PacketConn of a DTLS connection
+type datagramConn struct {
+	net.Conn
+}
+
+func (conn *datagramConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := conn.Read(b)
+	return n, conn.RemoteAddr(), err
+}
+
+func (conn *datagramConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr.String() != conn.RemoteAddr().String() {
+		return 0, ERROR_PEER
+	}
+	return conn.Write(b)
+}
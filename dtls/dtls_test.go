@@ -0,0 +1,87 @@
+//go:build dtls
+// +build dtls
+
+package dtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/inszva/instun"
+)
+
+// selfSigned returns a certificate for 127.0.0.1
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "instun"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServeDTLS(t *testing.T) {
+	listener, err := Listen("udp4", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{selfSigned(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun := &instun.Stun{}
+	served := make(chan error, 1)
+	go func () { served <- stun.Serve(context.Background(), listener) } ()
+
+	client, err := Dial("udp4", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 100 * time.Millisecond
+
+	result, err := client.Binding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mapped().Port != client.LocalAddr().(*net.UDPAddr).Port {
+		t.Error("mapped address error!")
+	}
+
+	// Only the server can be talked to
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := client.BindingTo(other.LocalAddr()); err != ERROR_PEER {
+		t.Error("DTLS request to another address!")
+	}
+
+	stun.Shutdown(context.Background())
+	select {
+	case err := <-served:
+		if err != instun.ERROR_SERVER_CLOSED {
+			t.Error("serve error!")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve doesn't return")
+	}
+}
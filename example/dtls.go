@@ -0,0 +1,21 @@
+//go:build dtls
+// +build dtls
+
+package main
+
+import (
+	"github.com/inszva/instun"
+	"github.com/inszva/instun/dtls"
+	"net"
+	"strconv"
+)
+
+func dtlsUDP(stun *instun.Stun) {
+	listener, err := dtls.Listen("udp", net.JoinHostPort(*FlagIP,
+		strconv.Itoa(*FlagTLSPort)), tlsConfig())
+	if err != nil {
+		panic(err)
+	}
+
+	stun.Run(listener)
+}
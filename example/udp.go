@@ -2,57 +2,122 @@ package main
 
 import (
 	"github.com/inszva/instun"
+	"context"
+	"flag"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 	"crypto/tls"
 )
 
-func dtls() {
+var (
+	FlagAlternate = flag.Bool("A", false,
+	"if this flag exist, the server run as a alternate server")
+	FlagSingle = flag.Bool("single", false,
+	"if this flag exist, the server run as both the primary and the\n" +
+	"alternate server, on a host with both ip addresses")
+	FlagIP = flag.String("ip", "192.168.1.113",
+	"the ip address of the primary server")
+	FlagIP6 = flag.String("ip6", "",
+	"the ipv6 address of the primary server, empty for ipv4 only")
+	FlagPort = flag.Int("port", instun.STUN_DEFAULT_PORT,
+	"the primary port for primay server")
+	FlagAlternateIP = flag.String("alterip", "192.168.1.114",
+	"the ip address of the alternate server")
+	FlagAlternateIP6 = flag.String("alterip6", "",
+	"the ipv6 address of the alternate server, empty for ipv4 only")
+	FlagAlternatePort = flag.Int("alterport", instun.STUN_DEFAULT_ALTERNATE_PORT,
+	"the alternate port")
+	FlagCommunicateIP = flag.String("commip", "192.168.1.113",
+	"the primary ip for communication, LAN IP recommended")
+	FlagCommunicatePort = flag.Int("commport", instun.PAIR_DEFAULT_PORT,
+	"the port for primay and alternate to communicate\n" +
+	"this port is the port primay server listen on")
+	FlagTLSPort = flag.Int("tlsport", instun.STUN_DEFAULT_TLS_PORT,
+	"the port for TLS and DTLS")
+	FlagSecret = flag.String("secret", "",
+	"the secret shared by primary and alternate to authenticate each other")
+)
+
+func tlsConfig() *tls.Config {
 	cert, err := tls.LoadX509KeyPair("server.pem", "server.key")
 	if err != nil {
 		panic(err)
-		return
 	}
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
 
-	listener, err := tls.Listen("tcp4", *instun.FlagIP + ":" +
-		strconv.Itoa(*instun.FlagPort), config)
+func tlsTCP(stun *instun.Stun) {
+	listener, err := tls.Listen("tcp", net.JoinHostPort(*FlagIP,
+		strconv.Itoa(*FlagTLSPort)), tlsConfig())
 	if err != nil {
 		panic(err)
 	}
 
-	(&instun.Stun{}).Run(listener)
+	stun.Run(listener)
 }
 
-func tcp() {
-	laddr, err := net.ResolveTCPAddr("tcp4", *instun.FlagIP + ":" +
-		strconv.Itoa(*instun.FlagPort))
+func tcp(stun *instun.Stun) {
+	laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(*FlagIP,
+		strconv.Itoa(*FlagPort)))
 	if err != nil {
 		panic(err)
 	}
 
-	listener, err := net.ListenTCP("tcp4", laddr)
+	listener, err := net.ListenTCP("tcp", laddr)
 	if err != nil {
 		panic(err)
 	}
 
-	(&instun.Stun{}).Run(listener)
+	stun.Run(listener)
 }
 
 func main() {
-	//go tcp()
-	//go dtls()
+	flag.Parse()
 
-	laddr, err := net.ResolveUDPAddr("udp4", *instun.FlagIP + ":" +
-		strconv.Itoa(*instun.FlagPort))
-	if err != nil {
-		panic(err)
+	stun := instun.NewStun(&instun.Config{
+		IP:              net.ParseIP(*FlagIP),
+		IP6:             net.ParseIP(*FlagIP6),
+		Port:            *FlagPort,
+		AlternateIP:     net.ParseIP(*FlagAlternateIP),
+		AlternateIP6:    net.ParseIP(*FlagAlternateIP6),
+		AlternatePort:   *FlagAlternatePort,
+		CommunicateIP:   net.ParseIP(*FlagCommunicateIP),
+		CommunicatePort: *FlagCommunicatePort,
+		Secret:          []byte(*FlagSecret),
+	})
+
+	// Each server answers on its ip at both ports
+	if *FlagSingle {
+		if err := stun.StartSingle(); err != nil {
+			panic(err)
+		}
+	} else if *FlagAlternate {
+		if err := stun.StartAlternate(); err != nil {
+			panic(err)
+		}
+	} else {
+		if err := stun.StartPrimary(); err != nil {
+			panic(err)
+		}
+
+		//go tcp(stun)
+		//go tlsTCP(stun)
+		//go dtlsUDP(stun) // -tags dtls
 	}
 
-	listener, err := net.ListenUDP("udp4", laddr)
-	if err != nil {
+	if err := stun.ListenUDP(); err != nil {
 		panic(err)
 	}
 
-	(&instun.Stun{}).RunUDP(listener)
-}
\ No newline at end of file
+	// Shut down gracefully, for restarts
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	stun.Shutdown(ctx)
+}
@@ -0,0 +1,244 @@
+// handler.go
+// This file describe how messages are dispatched. Stun has a mux
+// which keeps a Handler per method and class. Binding and the TURN
+// methods are registered by default, and can be replaced or joined
+// by handlers of custom methods and indications.
+//
+package instun
+
+import (
+	"net"
+	"sync"
+)
+
+// Request is a message received by the server, its fingerprint
+// and credentials are checked by stages of the pipeline
+type Request struct {
+	Msg  *StunMsg
+	Conn net.Conn // the client, responses go to it
+	ctx  *StunMsgCtx
+}
+
+// Username returns the user the request is authenticated
+// as, empty if it is not
+func (request *Request) Username() string {
+	return request.ctx.username
+}
+
+// ResponseWriter sends responses, with the SOFTWARE, the integrity
+// and the fingerprint the request asks for. Write sends rmsg, an
+// error response if ec is not nil, through conn, or to the client
+// if conn is nil.
+type ResponseWriter interface {
+	Write(rmsg *StunMsg, ec *ErrorCode, conn net.Conn) error
+}
+
+type Handler interface {
+	ServeSTUN(w ResponseWriter, request *Request)
+}
+
+// HandlerFunc makes a Handler of a function
+type HandlerFunc func(w ResponseWriter, request *Request)
+
+func (f HandlerFunc) ServeSTUN(w ResponseWriter, request *Request) {
+	f(w, request)
+}
+
+// Error answers request with an error response carrying attrs
+func Error(w ResponseWriter, request *Request, code uint16, reason string, attrs ...*StunAttr) error {
+	rmsg := NewStunMsg(request.Msg.Method(), STUN_CLASS_ERROR_RESP, request.Msg.Tid)
+	for _, attr := range attrs {
+		rmsg.AddAttr(attr)
+	}
+	return w.Write(rmsg, &ErrorCode{
+		Code: code,
+		Msg: reason,
+	}, nil)
+}
+
+// responseWriter encodes and sends, it is the last stage
+type responseWriter struct {
+	ctx  *StunMsgCtx
+	conn net.Conn
+}
+
+func (w *responseWriter) Write(rmsg *StunMsg, ec *ErrorCode, conn net.Conn) error {
+	data, err := encodeResponse(w.ctx, rmsg, ec)
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		conn = w.conn
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// ServeMux dispatches messages to the handler of their method and
+// class, messages without a handler are dropped
+type ServeMux struct {
+	mutex    sync.RWMutex
+	handlers map[uint16]Handler
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: make(map[uint16]Handler)}
+}
+
+func muxKey(method, class uint16) uint16 {
+	return method << 2 | class
+}
+
+// Handle registers handler for messages of method and class,
+// replacing the one registered before, nil removes it
+func (mux *ServeMux) Handle(method, class uint16, handler Handler) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	if handler == nil {
+		delete(mux.handlers, muxKey(method, class))
+		return
+	}
+	mux.handlers[muxKey(method, class)] = handler
+}
+
+func (mux *ServeMux) HandleFunc(method, class uint16, f func(ResponseWriter, *Request)) {
+	mux.Handle(method, class, HandlerFunc(f))
+}
+
+// Handler returns the handler of method and class, nil if there is none
+func (mux *ServeMux) Handler(method, class uint16) Handler {
+	mux.mutex.RLock()
+	defer mux.mutex.RUnlock()
+	return mux.handlers[muxKey(method, class)]
+}
+
+func (mux *ServeMux) ServeSTUN(w ResponseWriter, request *Request) {
+	if handler := mux.Handler(request.Msg.Method(), request.Msg.Class()); handler != nil {
+		handler.ServeSTUN(w, request)
+	}
+}
+
+// Mux returns the mux of the server, with Binding and the TURN
+// methods registered. TURN requests are answered with a 400 unless
+// stun.Turn is set, which may be done after the mux is built.
+func (stun *Stun) Mux() *ServeMux {
+	stun.muxOnce.Do(func () {
+		mux := NewServeMux()
+		mux.HandleFunc(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, stun.BindingHandler)
+
+		turn := HandlerFunc(func(w ResponseWriter, request *Request) {
+			if stun.Turn != nil {
+				stun.Turn.ServeSTUN(w, request)
+			} else if request.Msg.Class() == STUN_CLASS_REQUEST {
+				Error(w, request, 400, "Bad Request")
+			}
+		})
+		for _, method := range []uint16{STUN_METHOD_ALLOCATE, STUN_METHOD_REFRESH,
+			STUN_METHOD_CREATEPERM, STUN_METHOD_CHANBIND} {
+			mux.Handle(method, STUN_CLASS_REQUEST, turn)
+		}
+		mux.Handle(STUN_METHOD_SEND, STUN_CLASS_INDICATION, turn)
+		stun.mux = mux
+	})
+	return stun.mux
+}
+
+// Handle registers handler on the mux of the server
+func (stun *Stun) Handle(method, class uint16, handler Handler) {
+	stun.Mux().Handle(method, class, handler)
+}
+
+func (stun *Stun) HandleFunc(method, class uint16, f func(ResponseWriter, *Request)) {
+	stun.Mux().HandleFunc(method, class, f)
+}
+
+// Middleware wraps a handler with a stage of the pipeline, such as
+// logging or rate limiting. A stage may answer a request itself, or
+// pass it on, and may wrap the ResponseWriter to see the responses.
+type Middleware func(next Handler) Handler
+
+// Use adds middlewares to the pipeline, in the order they run. They
+// run for every message which has a handler, before the fingerprint,
+// the credentials and the unknown attributes are checked, so that
+// they see the messages these checks refuse as well. After
+// SetPipeline they are added at the end.
+func (stun *Stun) Use(middlewares ...Middleware) {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	stun.middlewares = append(stun.middlewares, middlewares...)
+	stun.stages = nil
+}
+
+// SetPipeline replaces the pipeline with middlewares, in the order
+// they run. The checks CheckFingerprint, stun.Authenticate and
+// RejectUnknownAttributes are left out unless they are among them,
+// so that a stage may run after the credentials are checked and see
+// request.Username(), e.g.
+//
+//	stun.SetPipeline(Logging(nil), CheckFingerprint, stun.Authenticate,
+//		RejectUnknownAttributes, metrics.Middleware)
+func (stun *Stun) SetPipeline(middlewares ...Middleware) {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	stun.middlewares = append([]Middleware{}, middlewares...)
+	stun.custom = true
+	stun.stages = nil
+}
+
+// pipeline returns the stages of the server wrapping its mux, they
+// are built once and again only after Use or SetPipeline
+func (stun *Stun) pipeline() Handler {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	if stun.stages != nil {
+		return stun.stages
+	}
+	middlewares := append([]Middleware{}, stun.middlewares...)
+	if !stun.custom {
+		middlewares = append(middlewares, CheckFingerprint, stun.Authenticate,
+			RejectUnknownAttributes)
+	}
+
+	var handler Handler = stun.Mux()
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	stun.stages = handler
+	return handler
+}
+
+// CheckFingerprint drops a message whose FINGERPRINT is wrong. The
+// responses carry one if the message does, whatever stage answers.
+func CheckFingerprint(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, request *Request) {
+		if request.ctx.fp && request.Msg.CheckFingerprint() != nil {
+			return
+		}
+		next.ServeSTUN(w, request)
+	})
+}
+
+// Authenticate checks the credentials of requests with the
+// mechanisms of the server, see stun.authenticate
+func (stun *Stun) Authenticate(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, request *Request) {
+		if request.Msg.Class() == STUN_CLASS_REQUEST && !stun.authenticate(w, request) {
+			return
+		}
+		next.ServeSTUN(w, request)
+	})
+}
+
+// RejectUnknownAttributes answers a request which has
+// comprehension-required attributes the server doesn't
+// know with a 420 listing them
+func RejectUnknownAttributes(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, request *Request) {
+		if request.Msg.Class() == STUN_CLASS_REQUEST && request.ctx.ua.Typec > 0 {
+			Error(w, request, 420, "Unkown Attribute",
+				NewStunAttr(STUN_ATTR_UNKNOWN_ATTR, &request.ctx.ua))
+			return
+		}
+		next.ServeSTUN(w, request)
+	})
+}
@@ -0,0 +1,177 @@
+package instun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+const testMethod = 0x0ff
+
+func TestStun_Handle(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	stun := &Stun{}
+	stun.HandleFunc(testMethod, STUN_CLASS_REQUEST, func(w ResponseWriter, request *Request) {
+		if request.Msg.PeekAttr(STUN_ATTR_USERNAME) == nil {
+			Error(w, request, 400, "Bad Request")
+			return
+		}
+		w.Write(NewStunMsg(testMethod, STUN_CLASS_SUCCESS_RESP, request.Msg.Tid), nil, nil)
+	})
+	indications := make(chan *Request, 1)
+	stun.HandleFunc(testMethod, STUN_CLASS_INDICATION, func(w ResponseWriter, request *Request) {
+		indications <- request
+	})
+	go stun.RunUDP(listener)
+
+	client, err := Dial("udp4", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+	client.Rc = 3
+
+	// A custom method
+	msg := NewStunMsg(testMethod, STUN_CLASS_REQUEST, NewTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, "user"))
+	rmsg, _, err := client.Request(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, rmsg.Class() == STUN_CLASS_SUCCESS_RESP && rmsg.Method() == testMethod, "custom response error!")
+	assert(t, rmsg.PeekAttr(STUN_ATTR_SOFTWARE) != nil, "no software in custom response!")
+
+	rmsg, _, err = client.Request(NewStunMsg(testMethod, STUN_CLASS_REQUEST, NewTid()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := rmsg.PeekAttr(STUN_ATTR_ERR_CODE)
+	assert(t, ec != nil && ec.AttrValue.(*ErrorCode).Code == 400, "custom error response error!")
+
+	// and an indication of it
+	data, _ := NewStunMsg(testMethod, STUN_CLASS_INDICATION, NewTid()).Encode(nil, nil, false, PADDING_BYTE)
+	client.conn.WriteTo(data, listener.LocalAddr())
+	select {
+	case <-indications:
+	case <-time.After(time.Second):
+		t.Fatal("indication not handled")
+	}
+
+	// Binding is still there, and can be removed
+	_, err = client.Binding()
+	assert(t, err == nil, "binding error!")
+	stun.Handle(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, nil)
+	_, err = client.Binding()
+	assert(t, err == ERROR_TIMEOUT, "removed binding handler answered!")
+}
+
+// codeWriter records the codes of the responses, 0 for a success
+type codeWriter struct {
+	ResponseWriter
+	codes chan uint16
+}
+
+func (w *codeWriter) Write(rmsg *StunMsg, ec *ErrorCode, conn net.Conn) error {
+	if ec != nil {
+		w.codes <- ec.Code
+	} else {
+		w.codes <- 0
+	}
+	return w.ResponseWriter.Write(rmsg, ec, conn)
+}
+
+func TestStun_Use(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	stun := &Stun{}
+
+	// A limit of two requests, and what is answered
+	codes := make(chan uint16, 10)
+	served := 0
+	stun.Use(func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, request *Request) {
+			if served++; served > 2 {
+				return
+			}
+			next.ServeSTUN(w, request)
+		})
+	}, func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, request *Request) {
+			next.ServeSTUN(&codeWriter{w, codes}, request)
+		})
+	})
+	go stun.RunUDP(listener)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := func(unknown bool) {
+		data, _ := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid()).Encode(nil, nil, false, PADDING_BYTE)
+		if unknown {
+			// A comprehension-required attribute of no meaning
+			data = append(data, 0x00, 0x30, 0x00, 0x04, 0, 0, 0, 0)
+			data[3] += 8
+		}
+		conn.WriteTo(data, listener.LocalAddr())
+	}
+	code := func() uint16 {
+		select {
+		case code := <-codes:
+			return code
+		case <-time.After(time.Second):
+			return 1
+		}
+	}
+
+	request(false)
+	assert(t, code() == 0, "binding error!")
+	request(true)
+	assert(t, code() == 420, "unknown attribute not rejected by the pipeline!")
+	request(false)
+	assert(t, code() == 1, "request over the limit answered!")
+}
+
+func TestStun_Pipeline(t *testing.T) {
+	stun := &Stun{}
+	built := 0
+	count := func(next Handler) Handler {
+		built++
+		return next
+	}
+	stun.Use(count)
+
+	// Built once for every message, and again after Use
+	stun.pipeline()
+	stun.pipeline()
+	assert(t, built == 1, "pipeline rebuilt per message!")
+	stun.Use(NewRateLimiter(1, time.Second).Middleware)
+	stun.pipeline()
+	assert(t, built == 2, "pipeline not rebuilt after Use!")
+}
+
+func TestStun_PipelineFingerprint(t *testing.T) {
+	// A stage before the checks answers with a FINGERPRINT as well
+	stun := &Stun{}
+	stun.Use(func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, request *Request) {
+			Error(w, request, 403, "Forbidden")
+		})
+	})
+	conn, server := startAuth(t, stun)
+
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	data, _ := msg.Encode(nil, nil, true, PADDING_BYTE)
+	rmsg := exchange(t, conn, server, data)
+	assert(t, responseCode(rmsg) == 403, "stage response error!")
+	assert(t, rmsg.PeekAttr(STUN_ATTR_FINGERPRINT) != nil, "no fingerprint in stage response!")
+}
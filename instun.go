@@ -8,6 +8,8 @@ const (
 type StunMsgCtx struct {
 	ua UnkownAttr
 	key []uint8
+	sha256 bool // MESSAGE-INTEGRITY-SHA256 instead of MESSAGE-INTEGRITY
 	fp bool
+	username string // authenticated
 }
 
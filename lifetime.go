@@ -0,0 +1,180 @@
+// lifetime.go
+// This file describe the binding lifetime discovery of RFC 5780
+// section 4.6. A socket X gets a binding, waits, and then a socket Y
+// asks the server to respond to the port of X with RESPONSE-PORT.
+// X gets the response only if the NAT still keeps its binding.
+//
+package instun
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ERROR_NO_LIFETIME = errors.New("InStun: binding doesn't live the shortest wait")
+)
+
+const (
+	LIFETIME_MIN = time.Second
+	LIFETIME_MAX = 10 * time.Minute
+	LIFETIME_PRECISION = time.Second
+	LIFETIME_CONCURRENCY = 4
+	LIFETIME_TIMEOUT = 2 * time.Second
+	LIFETIME_RETRIES = 3
+)
+
+// LifetimeDiscovery binary-searches how long a NAT keeps an idle
+// binding, between Min and Max. Each round waits Concurrency times
+// at once, each with sockets of its own, so a round splits the range
+// into Concurrency+1 parts.
+type LifetimeDiscovery struct {
+	Server      *net.UDPAddr
+	Min         time.Duration
+	Max         time.Duration
+	Precision   time.Duration // stop when the range is narrower
+	Concurrency int
+	// Requests are sent Retries times, after Timeout, 2*Timeout...
+	// as a Client does, and the binding is thought to be gone
+	// Timeout after the last one
+	Timeout time.Duration
+	Retries int
+}
+
+func NewLifetimeDiscovery(server *net.UDPAddr) *LifetimeDiscovery {
+	return &LifetimeDiscovery{
+		Server:      server,
+		Min:         LIFETIME_MIN,
+		Max:         LIFETIME_MAX,
+		Precision:   LIFETIME_PRECISION,
+		Concurrency: LIFETIME_CONCURRENCY,
+		Timeout:     LIFETIME_TIMEOUT,
+		Retries:     LIFETIME_RETRIES,
+	}
+}
+
+// Run returns the longest wait the binding was seen to live,
+// which is Max if no wait outlived it
+func (discovery *LifetimeDiscovery) Run() (time.Duration, error) {
+	if err := discovery.check(); err != nil {
+		return 0, err
+	}
+	low, high := discovery.Min, discovery.Max
+	if alive, err := discovery.probe(low); err != nil {
+		return 0, err
+	} else if !alive {
+		return 0, ERROR_NO_LIFETIME
+	}
+
+	count := discovery.Concurrency
+	if count < 1 {
+		count = 1
+	}
+	for high - low > discovery.Precision {
+		waits := make([]time.Duration, count)
+		alive := make([]bool, len(waits))
+		errs := make([]error, len(waits))
+		var group sync.WaitGroup
+		for i := range waits {
+			waits[i] = low + (high - low) * time.Duration(i + 1) / time.Duration(len(waits) + 1)
+			group.Add(1)
+			go func (i int) {
+				defer group.Done()
+				alive[i], errs[i] = discovery.probe(waits[i])
+			} (i)
+		}
+		group.Wait()
+
+		// The binding lived up to the last wait before the first
+		// one it didn't, later waits may be lucky
+		next := high
+		for i := range waits {
+			if errs[i] != nil {
+				return 0, errs[i]
+			}
+			if !alive[i] {
+				next = waits[i]
+				break
+			}
+			low = waits[i]
+		}
+		high = next
+	}
+	if high == discovery.Max {
+		return high, nil
+	}
+	return low, nil
+}
+
+// check makes sure the server supports RESPONSE-PORT, asking for
+// a response to the port of the binding of the same socket, so that
+// an error response comes back as well
+func (discovery *LifetimeDiscovery) check() error {
+	x, err := discovery.client()
+	if err != nil {
+		return err
+	}
+	defer x.Close()
+
+	result, err := x.Binding()
+	if err != nil {
+		return err
+	}
+	mapped := result.Mapped()
+	if mapped == nil {
+		return ERROR_NO_MAPPED_ADDRESS
+	}
+	_, err = x.BindingTo(nil, NewStunAttr(STUN_ATTR_RESP_PORT, uint16(mapped.Port)))
+	return err
+}
+
+// probe tells if a binding lives after being idle for wait
+func (discovery *LifetimeDiscovery) probe(wait time.Duration) (bool, error) {
+	x, err := discovery.client()
+	if err != nil {
+		return false, err
+	}
+	defer x.Close()
+	y, err := discovery.client()
+	if err != nil {
+		return false, err
+	}
+	defer y.Close()
+
+	result, err := x.Binding()
+	if err != nil {
+		return false, err
+	}
+	mapped := result.Mapped()
+	if mapped == nil {
+		return false, ERROR_NO_MAPPED_ADDRESS
+	}
+
+	time.Sleep(wait)
+
+	// y sends, x waits for the response
+	_, err = x.bindingVia(y, nil, NewStunAttr(STUN_ATTR_RESP_PORT, uint16(mapped.Port)))
+	if err == ERROR_TIMEOUT {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// client returns a client on a socket of its own,
+// retransmitting as Timeout and Retries say
+func (discovery *LifetimeDiscovery) client() (*Client, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(conn, discovery.Server)
+	client.RTO = discovery.Timeout
+	client.Rc = discovery.Retries
+	client.Rm = 1
+	if client.Rc < 1 {
+		client.Rc = 1
+	}
+	return client, nil
+}
@@ -0,0 +1,65 @@
+package instun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeBindings serves Binding requests as if behind a NAT dropping
+// bindings idle for lifetime: RESPONSE-PORT is only answered if the
+// port asked a Binding less than lifetime ago
+func fakeBindings(t *testing.T, lifetime time.Duration) *net.UDPAddr {
+	seen := make(map[int]time.Time)
+	return fakeBinding(t, func(msg *StunMsg, size int, from *net.UDPAddr) *net.UDPAddr {
+		rp := msg.PeekAttr(STUN_ATTR_RESP_PORT)
+		if rp == nil {
+			seen[from.Port] = time.Now()
+			return from
+		}
+		port := int(rp.AttrValue.(uint16))
+		if last, ok := seen[port]; !ok || time.Since(last) >= lifetime {
+			return nil
+		}
+		return &net.UDPAddr{IP: from.IP, Port: port}
+	})
+}
+
+func TestLifetimeDiscovery_Run(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&Stun{}).RunUDP(listener)
+
+	// Without a NAT the binding lives forever
+	discovery := NewLifetimeDiscovery(listener.LocalAddr().(*net.UDPAddr))
+	discovery.Min = 0
+	discovery.Max = 200 * time.Millisecond
+	discovery.Precision = 50 * time.Millisecond
+	discovery.Timeout = 100 * time.Millisecond
+	lifetime, err := discovery.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, lifetime == discovery.Max, "lifetime error: " + lifetime.String())
+}
+
+func TestLifetimeDiscovery_Threshold(t *testing.T) {
+	lifetime := 150 * time.Millisecond
+	discovery := NewLifetimeDiscovery(fakeBindings(t, lifetime))
+	discovery.Min = 0
+	discovery.Max = 400 * time.Millisecond
+	discovery.Precision = 20 * time.Millisecond
+	discovery.Timeout = 20 * time.Millisecond
+	discovery.Retries = 2
+
+	// The search converges below the lifetime, within the precision
+	found, err := discovery.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, found < lifetime && found >= lifetime - 2 * discovery.Precision,
+		"lifetime error: " + found.String())
+}
@@ -0,0 +1,291 @@
+// link.go
+// This file describe the protocol of the link between the primary and
+// the alternate server. Every frame is prefixed by its length. Both
+// sides first send a hello of the version and a nonce, then prove they
+// know the shared secret with an auth frame. Later frames carry a
+// sequence number and a HMAC-SHA256 made with a key of both nonces.
+// Each side pings the other every heartbeat, and closes the link
+// when it hears nothing for LINK_HEARTBEAT_MISSES heartbeats.
+//
+package instun
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ERROR_LINK_VERSION = errors.New("InStun: link version mismatch.")
+	ERROR_LINK_AUTH = errors.New("InStun: link authentication failed.")
+	ERROR_LINK_FRAME = errors.New("InStun: bad link frame.")
+	ERROR_NO_SECRET = errors.New("InStun: no link secret.")
+)
+
+const (
+	LINK_VERSION = 1
+	LINK_NONCE_SIZE = 16
+	LINK_LENGTH_SIZE = 4
+	LINK_SEQ_SIZE = 8
+	LINK_MAC_SIZE = sha256.Size
+	LINK_MAX_FRAME = MAX_PACKET_SIZE + 64
+	LINK_HANDSHAKE_TIMEOUT = 10 * time.Second
+	LINK_HEARTBEAT_INTERVAL = 5 * time.Second
+	LINK_HEARTBEAT_MISSES = 3
+
+	LINK_FRAME_HELLO = 1
+	LINK_FRAME_AUTH = 2
+	LINK_FRAME_DATA = 3
+	LINK_FRAME_PING = 4
+	LINK_FRAME_PONG = 5
+)
+
+// linkConn is an authenticated connection of the link
+type linkConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	key     []byte
+	primary bool
+
+	mutex   sync.Mutex // for writing
+	sendSeq uint64
+	recvSeq uint64
+
+	state    sync.Mutex
+	lastSeen time.Time
+	rtt      time.Duration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newLinkConn runs the handshake on conn, primary tells
+// which side of the link this is
+func newLinkConn(conn net.Conn, secret []byte, primary bool) (*linkConn, error) {
+	if len(secret) == 0 {
+		return nil, ERROR_NO_SECRET
+	}
+	link := &linkConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		primary: primary,
+		closed:  make(chan struct{}),
+	}
+	conn.SetDeadline(time.Now().Add(LINK_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, LINK_NONCE_SIZE)
+	rand.Read(nonce)
+	if err := link.writeRaw(append([]byte{LINK_FRAME_HELLO, LINK_VERSION}, nonce...)); err != nil {
+		return nil, err
+	}
+	hello, err := link.readRaw()
+	if err != nil {
+		return nil, err
+	}
+	if len(hello) != 2 + LINK_NONCE_SIZE || hello[0] != LINK_FRAME_HELLO {
+		return nil, ERROR_LINK_FRAME
+	}
+	if hello[1] != LINK_VERSION {
+		return nil, ERROR_LINK_VERSION
+	}
+
+	// The key is made of the nonce of the primary first
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(SOFTWARE))
+	if primary {
+		h.Write(nonce)
+		h.Write(hello[2:])
+	} else {
+		h.Write(hello[2:])
+		h.Write(nonce)
+	}
+	link.key = h.Sum(nil)
+
+	if err := link.writeFrame(LINK_FRAME_AUTH, nil); err != nil {
+		return nil, err
+	}
+	if tp, _, err := link.readFrame(); err != nil {
+		return nil, err
+	} else if tp != LINK_FRAME_AUTH {
+		return nil, ERROR_LINK_AUTH
+	}
+	return link, nil
+}
+
+func (link *linkConn) writeRaw(b []byte) error {
+	buff := make([]byte, LINK_LENGTH_SIZE, LINK_LENGTH_SIZE + len(b))
+	binary.BigEndian.PutUint32(buff, uint32(len(b)))
+	_, err := link.conn.Write(append(buff, b...))
+	return err
+}
+
+func (link *linkConn) readRaw() ([]byte, error) {
+	head := make([]byte, LINK_LENGTH_SIZE)
+	if _, err := io.ReadFull(link.reader, head); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head)
+	if size > LINK_MAX_FRAME {
+		return nil, ERROR_LINK_FRAME
+	}
+	buff := make([]byte, size)
+	if _, err := io.ReadFull(link.reader, buff); err != nil {
+		return nil, err
+	}
+	return buff, nil
+}
+
+// mac signs a frame, with the side which sends
+// it so that it can't be reflected
+func (link *linkConn) mac(fromPrimary bool, frame []byte) []byte {
+	h := hmac.New(sha256.New, link.key)
+	if fromPrimary {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	h.Write(frame)
+	return h.Sum(nil)
+}
+
+func (link *linkConn) writeFrame(tp byte, payload []byte) error {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	frame := make([]byte, 1 + LINK_SEQ_SIZE, 1 + LINK_SEQ_SIZE + len(payload) + LINK_MAC_SIZE)
+	frame[0] = tp
+	binary.BigEndian.PutUint64(frame[1:], link.sendSeq)
+	frame = append(frame, payload...)
+	frame = append(frame, link.mac(link.primary, frame)...)
+	link.sendSeq++
+	return link.writeRaw(frame)
+}
+
+// readFrame returns the next frame, a frame which is not signed
+// or out of sequence breaks the link
+func (link *linkConn) readFrame() (byte, []byte, error) {
+	frame, err := link.readRaw()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(frame) < 1 + LINK_SEQ_SIZE + LINK_MAC_SIZE {
+		return 0, nil, ERROR_LINK_FRAME
+	}
+	body := frame[:len(frame) - LINK_MAC_SIZE]
+	if !hmac.Equal(frame[len(body):], link.mac(!link.primary, body)) {
+		return 0, nil, ERROR_LINK_AUTH
+	}
+	if binary.BigEndian.Uint64(body[1:]) != link.recvSeq {
+		return 0, nil, ERROR_LINK_AUTH
+	}
+	link.recvSeq++
+
+	link.state.Lock()
+	link.lastSeen = time.Now()
+	link.state.Unlock()
+	return body[0], body[1 + LINK_SEQ_SIZE:], nil
+}
+
+// Write sends b in a data frame
+func (link *linkConn) Write(b []byte) (int, error) {
+	if err := link.writeFrame(LINK_FRAME_DATA, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the payload of the next data frame,
+// b must be large enough for it. It answers pings
+// and measures the round trip time with pongs.
+func (link *linkConn) Read(b []byte) (int, error) {
+	for {
+		tp, payload, err := link.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch tp {
+		case LINK_FRAME_PING:
+			if err := link.writeFrame(LINK_FRAME_PONG, payload); err != nil {
+				return 0, err
+			}
+			continue
+		case LINK_FRAME_PONG:
+			if len(payload) == 8 {
+				sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+				link.state.Lock()
+				link.rtt = time.Since(sent)
+				link.state.Unlock()
+			}
+			continue
+		case LINK_FRAME_DATA:
+		default:
+			continue
+		}
+		if len(payload) > len(b) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(b, payload), nil
+	}
+}
+
+// heartbeat pings the other side every interval, until the link
+// is closed, and closes it if the other side goes quiet
+func (link *linkConn) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-link.closed:
+			return
+		case <-ticker.C:
+		}
+		if !link.alive(interval) {
+			debug("link: heartbeat timeout")
+			link.Close()
+			return
+		}
+		stamp := make([]byte, 8)
+		binary.BigEndian.PutUint64(stamp, uint64(time.Now().UnixNano()))
+		if link.writeFrame(LINK_FRAME_PING, stamp) != nil {
+			link.Close()
+			return
+		}
+	}
+}
+
+// alive tells if the link is open and the other side
+// was heard of within the heartbeat misses
+func (link *linkConn) alive(interval time.Duration) bool {
+	select {
+	case <-link.closed:
+		return false
+	default:
+	}
+	link.state.Lock()
+	defer link.state.Unlock()
+	return time.Since(link.lastSeen) <= interval * LINK_HEARTBEAT_MISSES
+}
+
+// RTT returns the round trip time of the last heartbeat
+func (link *linkConn) RTT() time.Duration {
+	link.state.Lock()
+	defer link.state.Unlock()
+	return link.rtt
+}
+
+func (link *linkConn) Close() error {
+	var err error
+	link.closeOnce.Do(func () {
+		close(link.closed)
+		err = link.conn.Close()
+	})
+	return err
+}
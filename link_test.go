@@ -0,0 +1,113 @@
+package instun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// linkPair returns both sides of a link over loopback TCP
+func linkPair(t *testing.T, primarySecret, alternateSecret []byte) (*linkConn, *linkConn, error) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		link *linkConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func () {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+		link, err := newLinkConn(conn, primarySecret, true)
+		if err != nil {
+			conn.Close()
+		}
+		done <- result{link, err}
+	} ()
+
+	conn, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alternate, err := newLinkConn(conn, alternateSecret, false)
+	if err != nil {
+		conn.Close()
+	}
+	primary := <-done
+	if primary.err != nil {
+		return nil, nil, primary.err
+	}
+	return primary.link, alternate, err
+}
+
+func TestLinkConn(t *testing.T) {
+	primary, alternate, err := linkPair(t, []byte("secret"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	defer alternate.Close()
+
+	// Frames written at once come out one by one
+	for i := 0; i < 100; i++ {
+		primary.Write(bytes.Repeat([]byte{byte(i)}, i + 1))
+	}
+	buff := make([]byte, MAX_PACKET_SIZE)
+	for i := 0; i < 100; i++ {
+		n, err := alternate.Read(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, bytes.Equal(buff[:n], bytes.Repeat([]byte{byte(i)}, i + 1)), "frame error!")
+	}
+
+	// and both ways
+	alternate.Write([]byte("pong"))
+	n, err := primary.Read(buff)
+	assert(t, err == nil && string(buff[:n]) == "pong", "frame error!")
+}
+
+func TestLinkConn_WrongSecret(t *testing.T) {
+	_, _, err := linkPair(t, []byte("secret"), []byte("wrong"))
+	assert(t, err == ERROR_LINK_AUTH, "link with a wrong secret established!")
+}
+
+func TestLinkConn_Tampered(t *testing.T) {
+	primary, alternate, err := linkPair(t, []byte("secret"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	defer alternate.Close()
+
+	// A frame replayed or not signed with the key is refused
+	frame := []byte{LINK_FRAME_DATA, 0, 0, 0, 0, 0, 0, 0, 0}
+	frame = append(frame, primary.mac(false, frame)...)
+	alternate.writeRaw(frame)
+	_, err = primary.Read(make([]byte, MAX_PACKET_SIZE))
+	assert(t, err == ERROR_LINK_AUTH, "tampered frame accepted!")
+}
+
+func TestLinkConn_Heartbeat(t *testing.T) {
+	primary, alternate, err := linkPair(t, []byte("secret"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	defer alternate.Close()
+
+	// The alternate side doesn't read, so it never answers
+	interval := 10 * time.Millisecond
+	go primary.heartbeat(interval)
+	go primary.Read(make([]byte, MAX_PACKET_SIZE))
+	time.Sleep(interval * (LINK_HEARTBEAT_MISSES + 3))
+	assert(t, !primary.alive(interval), "link of a quiet side alive!")
+}
@@ -1,3 +1,4 @@
+//go:build !product
 // +build !product
 
 package instun
@@ -7,9 +8,9 @@ import (
 )
 
 func debug(v... interface{}) {
-	log.Println(v)
+	log.Println(v...)
 }
 
 func debugf(f string, v... interface{}) {
-	log.Printf(f, v)
+	log.Printf(f, v...)
 }
\ No newline at end of file
@@ -1,3 +1,4 @@
+//go:build product
 // +build product
 
 package instun
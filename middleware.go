@@ -0,0 +1,128 @@
+// middleware.go
+// This file describe stages of the pipeline logging and counting
+// the messages and the responses to them, see Stun.Use and
+// Stun.SetPipeline.
+//
+package instun
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseRecorder passes the responses on, and keeps their codes,
+// 0 for a success
+type responseRecorder struct {
+	ResponseWriter
+	mutex sync.Mutex
+	codes []uint16
+}
+
+func (w *responseRecorder) Write(rmsg *StunMsg, ec *ErrorCode, conn net.Conn) error {
+	code := uint16(0)
+	if ec != nil {
+		code = ec.Code
+	}
+	w.mutex.Lock()
+	w.codes = append(w.codes, code)
+	w.mutex.Unlock()
+	return w.ResponseWriter.Write(rmsg, ec, conn)
+}
+
+// answered returns the codes of the responses so far
+func (w *responseRecorder) answered() []uint16 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]uint16{}, w.codes...)
+}
+
+// Logging logs every message, the responses to it and how long it
+// took, with logger or the standard one if it is nil
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, request *Request) {
+			start := time.Now()
+			recorder := &responseRecorder{ResponseWriter: w}
+			next.ServeSTUN(recorder, request)
+
+			var responses []string
+			for _, code := range recorder.answered() {
+				if code == 0 {
+					responses = append(responses, "success")
+				} else {
+					responses = append(responses, fmt.Sprintf("error %d", code))
+				}
+			}
+			if len(responses) == 0 {
+				responses = append(responses, "no response")
+			}
+			logger.Printf("stun: method 0x%03x class %d from %v: %s in %v",
+				request.Msg.Method(), request.Msg.Class(), request.Conn.RemoteAddr(),
+				strings.Join(responses, ", "), time.Since(start))
+		})
+	}
+}
+
+// Metrics counts the messages by method and class, the responses
+// by code, and the requests left unanswered
+type Metrics struct {
+	mutex      sync.Mutex
+	messages   map[uint16]uint64
+	responses  map[uint16]uint64
+	unanswered uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		messages:  make(map[uint16]uint64),
+		responses: make(map[uint16]uint64),
+	}
+}
+
+// Middleware counts the messages which come to this stage
+func (metrics *Metrics) Middleware(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, request *Request) {
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeSTUN(recorder, request)
+
+		codes := recorder.answered()
+		metrics.mutex.Lock()
+		defer metrics.mutex.Unlock()
+		metrics.messages[muxKey(request.Msg.Method(), request.Msg.Class())]++
+		for _, code := range codes {
+			metrics.responses[code]++
+		}
+		if len(codes) == 0 && request.Msg.Class() == STUN_CLASS_REQUEST {
+			metrics.unanswered++
+		}
+	})
+}
+
+// Messages returns the count of messages of method and class
+func (metrics *Metrics) Messages(method, class uint16) uint64 {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	return metrics.messages[muxKey(method, class)]
+}
+
+// Responses returns the count of responses with code, 0 for successes
+func (metrics *Metrics) Responses(code uint16) uint64 {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	return metrics.responses[code]
+}
+
+// Unanswered returns the count of requests dropped by the
+// next stages or their handler
+func (metrics *Metrics) Unanswered() uint64 {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	return metrics.unanswered
+}
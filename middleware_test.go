@@ -0,0 +1,86 @@
+package instun
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lineWriter passes the lines logged on
+type lineWriter chan string
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestLogging(t *testing.T) {
+	lines := make(lineWriter, 10)
+	stun := &Stun{}
+	stun.Use(Logging(log.New(lines, "", 0)))
+	conn, server := startAuth(t, stun)
+	line := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	exchange(t, conn, server, encode(t, msg, nil))
+	l := line()
+	assert(t, strings.Contains(l, "method 0x001 class 0") && strings.Contains(l, "success") &&
+		strings.Contains(l, conn.LocalAddr().String()), "binding log error!")
+
+	// A comprehension-required attribute of no meaning
+	data := encode(t, NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid()), nil)
+	data = append(data, 0x00, 0x30, 0x00, 0x04, 0, 0, 0, 0)
+	data[3] += 8
+	exchange(t, conn, server, data)
+	assert(t, strings.Contains(line(), "error 420"), "refused request log error!")
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	stun := &Stun{ShortTerm: &ShortTermAuth{
+		Password: func(username string) (string, bool) {
+			return "pass", username == "user" || username == "blocked"
+		},
+	}}
+	// A stage of its own for each user, after the credentials
+	blocked := func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, request *Request) {
+			if request.Username() != "blocked" {
+				next.ServeSTUN(w, request)
+			}
+		})
+	}
+	stun.SetPipeline(CheckFingerprint, stun.Authenticate, metrics.Middleware,
+		blocked, RejectUnknownAttributes)
+	conn, server := startAuth(t, stun)
+	binding := func(username string) []byte {
+		msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+		msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, username))
+		return encode(t, msg, []byte("pass"))
+	}
+
+	rmsg := exchange(t, conn, server, binding("user"))
+	assert(t, responseCode(rmsg) == 0, "authenticated request refused!")
+	rmsg = exchange(t, conn, server, binding("nobody"))
+	assert(t, responseCode(rmsg) == 401, "unknown user passed!")
+	conn.WriteToUDP(binding("blocked"), server)
+	for i := 0; metrics.Unanswered() == 0; i++ {
+		if i > 100 {
+			t.Fatal("blocked request not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The refused user never comes to the metrics
+	assert(t, metrics.Messages(STUN_METHOD_BINDING, STUN_CLASS_REQUEST) == 2, "message count error!")
+	assert(t, metrics.Responses(0) == 1 && metrics.Responses(401) == 0, "response count error!")
+	assert(t, metrics.Unanswered() == 1, "unanswered count error!")
+}
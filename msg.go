@@ -2,11 +2,12 @@ package instun
 
 import (
 	"errors"
-	"bytes"
+	"hash"
 	"io"
 	"encoding/binary"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/json"
 )
 
@@ -15,6 +16,7 @@ const (
 	STUN_TID_SIZE = 12
 	FP_SIZE = 8
      MI_SIZE = 24
+	MI_SHA256_SIZE = 36
 )
 
 var (
@@ -78,13 +80,32 @@ func DecodeStunMsg(reader *StunReader, ua *UnkownAttr) (*StunMsg, error) {
 	}
 
 	extra := reader.Left() - int64(msg.MsgLen)
-	for reader.Left() - extra > 4 {
-		attr, err := DecodeStunAttr(reader, ua, tid)
+	var integrity uint16 // the last integrity attribute
+	for reader.Left() - extra >= 4 {
+		off := reader.off - reader.base
+		// Unknown attributes after the integrity are ignored too
+		attrUA := ua
+		if integrity != 0 {
+			attrUA = nil
+		}
+		attr, err := DecodeStunAttr(reader, attrUA, tid)
 		if err != nil {
 			break
 		}
-		if attr != nil {
-			msg.Attr = append(msg.Attr, attr)
+		if attr == nil || ignoredAfter(integrity, attr.AttrType) {
+			continue
+		}
+		attr.off = int(off)
+		msg.Attr = append(msg.Attr, attr)
+		switch attr.AttrType {
+		case STUN_ATTR_MSG_INTEGRITY: fallthrough
+		case STUN_ATTR_MSG_INTEGRITY_SHA256:
+			integrity = attr.AttrType
+		case STUN_ATTR_FINGERPRINT:
+			// FINGERPRINT must be the last attribute
+			if reader.Left() - extra > 0 {
+				return nil, ERROR_BAD_MESSAGE
+			}
 		}
 	}
 	reader.Reset()
@@ -92,36 +113,50 @@ func DecodeStunMsg(reader *StunReader, ua *UnkownAttr) (*StunMsg, error) {
 	return msg, nil
 }
 
+// ignoredAfter reports whether an attribute of attrType following
+// the integrity attribute is ignored, since it is not authenticated.
+// Only MESSAGE-INTEGRITY-SHA256 may follow MESSAGE-INTEGRITY, and
+// FINGERPRINT both, see RFC 8489 section 14.5 and 14.6.
+func ignoredAfter(integrity uint16, attrType uint16) bool {
+	switch integrity {
+	case STUN_ATTR_MSG_INTEGRITY:
+		return attrType != STUN_ATTR_MSG_INTEGRITY_SHA256 &&
+			attrType != STUN_ATTR_FINGERPRINT
+	case STUN_ATTR_MSG_INTEGRITY_SHA256:
+		return attrType != STUN_ATTR_FINGERPRINT
+	}
+	return false
+}
+
 func (msg *StunMsg) Class() uint16 {
-	return (msg.MsgType >> 7 | msg.MsgType >> 4) & 0x3
+	return (msg.MsgType >> 7) & 0x2 | (msg.MsgType >> 4) & 0x1
 }
 
 func (msg *StunMsg) Method() uint16 {
 	return (msg.MsgType&0x3e00)>>2 | (msg.MsgType&0x00e0)>>1 | (msg.MsgType&0x000f)
 }
 
-func (msg *StunMsg) MakeMessageIntegrity(key []uint8) ([]byte, error) {
-	var header []byte
-
-	fp := msg.PeekAttr(STUN_ATTR_FINGERPRINT)
-	if fp != nil {
-		msg.MsgLen -= FP_SIZE
-	}
-	header = msg.EncodeHeader()
-
-	h := hmac.New(sha1.New, key)
-	h.Write(header)
-	msg.Reader.Seek(STUN_HEADER_LENGTH, io.SeekStart)
-	buff := make([]byte, msg.MsgLen - MI_SIZE)
-	msg.Reader.Read(buff)
+// integrity computes the HMAC of the decoded message up to the
+// attribute at off, with the length in the header ending at that
+// attribute whose size is size
+func (msg *StunMsg) integrity(h hash.Hash, off int, size int) []byte {
+	msgLen := msg.MsgLen
+	msg.MsgLen = uint16(off - STUN_HEADER_LENGTH + size)
+	h.Write(msg.EncodeHeader())
+	msg.MsgLen = msgLen
+
+	buff := make([]byte, off - STUN_HEADER_LENGTH)
+	msg.Reader.ReadAt(buff, STUN_HEADER_LENGTH)
 	h.Write(buff)
-	integrity := h.Sum(nil)
+	return h.Sum(nil)
+}
 
-	if fp != nil {
-		msg.MsgLen += FP_SIZE
+func (msg *StunMsg) MakeMessageIntegrity(key []uint8) ([]byte, error) {
+	mi := msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY)
+	if mi == nil || msg.Reader == nil {
+		return nil, ERROR_PROTO_ERROR
 	}
-
-	return integrity, nil
+	return msg.integrity(hmac.New(sha1.New, key), mi.off, MI_SIZE), nil
 }
 
 func (msg *StunMsg) CheckMessageIntegrity(key []uint8) error {
@@ -131,11 +166,31 @@ func (msg *StunMsg) CheckMessageIntegrity(key []uint8) error {
 	}
 
 	mi := msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY)
-	if mi == nil {
-		return ERROR_PROTO_ERROR
+	if hmac.Equal(integrity, mi.AttrValue.([]byte)) {
+		return nil
+	}
+	return ERROR_BAD_MESSAGE
+}
+
+func (msg *StunMsg) MakeMessageIntegritySHA256(key []uint8) ([]byte, error) {
+	mi := msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY_SHA256)
+	if mi == nil || msg.Reader == nil {
+		return nil, ERROR_PROTO_ERROR
+	}
+	size := 4 + len(mi.AttrValue.([]byte))
+	return msg.integrity(hmac.New(sha256.New, key), mi.off, size), nil
+}
+
+// CheckMessageIntegritySHA256 checks MESSAGE-INTEGRITY-SHA256,
+// which may be truncated
+func (msg *StunMsg) CheckMessageIntegritySHA256(key []uint8) error {
+	integrity, err := msg.MakeMessageIntegritySHA256(key)
+	if err != nil {
+		return err
 	}
 
-	if bytes.Equal(integrity, mi.AttrValue.([]byte)) {
+	mi := msg.PeekAttr(STUN_ATTR_MSG_INTEGRITY_SHA256).AttrValue.([]byte)
+	if hmac.Equal(integrity[:len(mi)], mi) {
 		return nil
 	}
 	return ERROR_BAD_MESSAGE
@@ -147,7 +202,15 @@ func (msg *StunMsg) CheckFingerprint() error {
 		return ERROR_PROTO_ERROR
 	}
 
-	//TODO
+	// FINGERPRINT is the last attribute and covers
+	// the whole message before it
+	buff := make([]byte, STUN_HEADER_LENGTH + int(msg.MsgLen) - FP_SIZE)
+	if n, e := msg.Reader.ReadAt(buff, 0); n != len(buff) || (e != nil && e != io.EOF) {
+		return ERROR_BAD_MESSAGE
+	}
+	if fingerPrint(buff) != fp.AttrValue.(uint32) {
+		return ERROR_BAD_MESSAGE
+	}
 	return nil
 }
 
@@ -190,6 +253,18 @@ func (msg *StunMsg) AddAttr(attr *StunAttr) {
 // to bytes
 func (msg *StunMsg) Encode(ec *ErrorCode, key []uint8, fingerprint bool,
 	paddingByte uint8) ([]byte, error) {
+	return msg.encode(ec, key, STUN_ATTR_MSG_INTEGRITY, fingerprint, paddingByte)
+}
+
+// EncodeSHA256 is like Encode, but adds MESSAGE-INTEGRITY-SHA256
+// instead of MESSAGE-INTEGRITY
+func (msg *StunMsg) EncodeSHA256(ec *ErrorCode, key []uint8, fingerprint bool,
+	paddingByte uint8) ([]byte, error) {
+	return msg.encode(ec, key, STUN_ATTR_MSG_INTEGRITY_SHA256, fingerprint, paddingByte)
+}
+
+func (msg *StunMsg) encode(ec *ErrorCode, key []uint8, integrity uint16,
+	fingerprint bool, paddingByte uint8) ([]byte, error) {
 
 	tid := make([]byte, 12)
 	for i := 0; i < 12; i++ {
@@ -198,14 +273,14 @@ func (msg *StunMsg) Encode(ec *ErrorCode, key []uint8, fingerprint bool,
 
 	body := make([]byte, 0)
 
+	// ERROR-CODE goes first, attributes such as REALM and NONCE
+	// of a 401 response follow it
 	if ec != nil {
 		buff, err := NewStunAttr(STUN_ATTR_ERR_CODE, ec).Encode(tid, paddingByte)
 		if err != nil {
 			return nil, err
 		}
 		body = append(body, buff...)
-		msg.MsgLen = uint16(len(body))
-		goto CONTACT
 	}
 
 	for i := 0; i < len(msg.Attr); i++ {
@@ -220,13 +295,19 @@ func (msg *StunMsg) Encode(ec *ErrorCode, key []uint8, fingerprint bool,
 	msg.MsgLen = uint16(len(body))
 
 	if key != nil {
-		msg.MsgLen += MI_SIZE
-		h := hmac.New(sha1.New, key)
+		var h hash.Hash
+		if integrity == STUN_ATTR_MSG_INTEGRITY_SHA256 {
+			msg.MsgLen += MI_SHA256_SIZE
+			h = hmac.New(sha256.New, key)
+		} else {
+			msg.MsgLen += MI_SIZE
+			h = hmac.New(sha1.New, key)
+		}
 		header := msg.EncodeHeader()
 		h.Write(header)
 		h.Write(body)
 		mi := h.Sum(nil)
-		buff, err := NewStunAttr(STUN_ATTR_MSG_INTEGRITY, mi).Encode(tid, paddingByte)
+		buff, err := NewStunAttr(integrity, mi).Encode(tid, paddingByte)
 		if err != nil {
 			return nil, err
 		}
@@ -244,7 +325,6 @@ func (msg *StunMsg) Encode(ec *ErrorCode, key []uint8, fingerprint bool,
 		body = append(body, buff...)
 	}
 
-CONTACT:
 	msg.MsgLen = uint16(len(body))
 	header := msg.EncodeHeader()
 	return append(header, body...), nil
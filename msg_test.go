@@ -1,9 +1,10 @@
 package instun
 
 import (
+	"net"
 	"testing"
+	"encoding/binary"
 	"encoding/json"
-	"crypto/md5"
 )
 
 const (
@@ -69,7 +70,160 @@ func TestStunMsg_CheckMessageIntegrity(t *testing.T) {
 	t.Log(msg.CheckMessageIntegrity())
 }*/
 
+// RFC 5769 section 2.1, a request with a short-term password
+var rfc5769Request = []byte{
+	0x00, 0x01, 0x00, 0x58, 0x21, 0x12, 0xa4, 0x42,
+	0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae,
+	0x80, 0x22, 0x00, 0x10, 0x53, 0x54, 0x55, 0x4e, 0x20, 0x74, 0x65, 0x73,
+	0x74, 0x20, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74,
+	0x00, 0x24, 0x00, 0x04, 0x6e, 0x00, 0x01, 0xff,
+	0x80, 0x29, 0x00, 0x08, 0x93, 0x2f, 0xf9, 0xb1, 0x51, 0x26, 0x3b, 0x36,
+	0x00, 0x06, 0x00, 0x09, 0x65, 0x76, 0x74, 0x6a, 0x3a, 0x68, 0x36, 0x76,
+	0x59, 0x20, 0x20, 0x20,
+	0x00, 0x08, 0x00, 0x14, 0x9a, 0xea, 0xa7, 0x0c, 0xbf, 0xd8, 0xcb, 0x56,
+	0x78, 0x1e, 0xf2, 0xb5, 0xb2, 0xd3, 0xf2, 0x49, 0xc1, 0xb5, 0x71, 0xa2,
+	0x80, 0x28, 0x00, 0x04, 0xe5, 0x7a, 0x3b, 0xcf,
+}
+
 func TestStunMsg_MakeMessageIntegrity(t *testing.T) {
-	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST,
-		[STUN_TID_SIZE]uint8{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8, 0x9, 0x10, 0x11, 0x12})
+	msg, err := DecodeStunMsg(NewStunReaderFromBytes(rfc5769Request), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("VOkJxbRl1RmTxUk/WvJxBt")
+	integrity, err := msg.MakeMessageIntegrity(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, string(integrity) == string(rfc5769Request[80:100]), "integrity error!")
+	assert(t, msg.CheckMessageIntegrity(key) == nil, "integrity check error!")
+	assert(t, msg.CheckMessageIntegrity([]byte("wrong")) != nil, "wrong key passed!")
+
+	_, err = NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, rawTid()).MakeMessageIntegrity(key)
+	assert(t, err != nil, "integrity of a message without one!")
+}
+
+func TestStunMsg_CheckFingerprint(t *testing.T) {
+	rawStun := make([]byte, len(rawData[0]))
+	copy(rawStun, rawData[0])
+	msg, err := DecodeStunMsg(NewStunReaderFromBytes(rawStun), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.CheckFingerprint() == nil, "fingerprint error!")
+
+	rawStun[30] ^= 0x1
+	msg, err = DecodeStunMsg(NewStunReaderFromBytes(rawStun), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.CheckFingerprint() != nil, "corrupted message passed!")
+
+	// Nothing may follow FINGERPRINT
+	data, _ := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, msg.Tid).
+		Encode(nil, nil, true, PADDING_BYTE)
+	data = append(data, 0x80, 0x22, 0x00, 0x00)
+	data[3] += 4
+	_, err = DecodeStunMsg(NewStunReaderFromBytes(data), nil)
+	assert(t, err != nil, "attribute after fingerprint passed!")
+
+	// FINGERPRINT covers MESSAGE-INTEGRITY as well
+	msg = NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, rawTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, "user"))
+	data, err = msg.Encode(nil, []byte("key"), true, PADDING_BYTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = DecodeStunMsg(NewStunReaderFromBytes(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.CheckFingerprint() == nil, "fingerprint over integrity error!")
+
+	// and the RFC 5769 sample request
+	msg, err = DecodeStunMsg(NewStunReaderFromBytes(rfc5769Request), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.CheckFingerprint() == nil, "sample request fingerprint error!")
+}
+
+func TestDecodeStunMsg_AfterIntegrity(t *testing.T) {
+	key := []byte("key")
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, rawTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, "user"))
+	data, err := msg.Encode(nil, key, false, PADDING_BYTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appended on the path: CHANGE-REQUEST, RESPONSE-PORT, an unknown
+	// comprehension-required attribute, and then a FINGERPRINT
+	data = append(data, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, 0x06)
+	data = append(data, 0x00, 0x27, 0x00, 0x02, 0x12, 0x34, 0x00, 0x00)
+	data = append(data, 0x7f, 0xf0, 0x00, 0x00)
+	binary.BigEndian.PutUint16(data[2:], uint16(len(data) - STUN_HEADER_LENGTH + FP_SIZE))
+	fp := make([]byte, 4)
+	binary.BigEndian.PutUint32(fp, fingerPrint(data))
+	data = append(append(data, 0x80, 0x28, 0x00, 0x04), fp...)
+
+	var ua UnkownAttr
+	msg, err = DecodeStunMsg(NewStunReaderFromBytes(data), &ua)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.PeekAttr(STUN_ATTR_CHANGE_REQ) == nil, "change-request after integrity kept!")
+	assert(t, msg.PeekAttr(STUN_ATTR_RESP_PORT) == nil, "response-port after integrity kept!")
+	assert(t, ua.Typec == 0, "unknown attribute after integrity reported!")
+	assert(t, msg.CheckMessageIntegrity(key) == nil, "integrity error!")
+	assert(t, msg.CheckFingerprint() == nil, "fingerprint after integrity dropped!")
+}
+
+func TestStunMsg_CheckMessageIntegritySHA256(t *testing.T) {
+	key := PasswordKey(PASSWORD_ALGORITHM_SHA256, "user", "realm", "pass")
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, rawTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_USERHASH, UserHash("user", "realm")))
+	msg.AddAttr(NewStunAttr(STUN_ATTR_PASSWORD_ALGORITHM,
+		&PasswordAlgorithm{Algorithm: PASSWORD_ALGORITHM_SHA256}))
+	data, err := msg.EncodeSHA256(nil, key, true, PADDING_BYTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = DecodeStunMsg(NewStunReaderFromBytes(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.CheckMessageIntegritySHA256(key) == nil, "mi-sha256 error!")
+	assert(t, msg.CheckMessageIntegritySHA256([]byte("wrong")) != nil, "wrong key passed!")
+	assert(t, msg.CheckFingerprint() == nil, "fingerprint error!")
+	pa := msg.PeekAttr(STUN_ATTR_PASSWORD_ALGORITHM)
+	assert(t, pa != nil && pa.AttrValue.(*PasswordAlgorithm).Algorithm == PASSWORD_ALGORITHM_SHA256,
+		"password algorithm error!")
+}
+
+func rawTid() (tid [STUN_TID_SIZE]byte) {
+	copy(tid[:], rawData[0][8:20])
+	return
+}
+
+func TestStunMsg_IPv6Address(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_SUCCESS_RESP, rawTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_XOR_MAPPED_ADDR,
+		NewStunAddr(normalizeIP(ip), 3478).Xor(msg.Tid[:])))
+	msg.AddAttr(NewStunAttr(STUN_ATTR_OTHER_ADDR,
+		NewStunAddr(normalizeIP(ip), 3479)))
+	data, err := msg.Encode(nil, nil, false, PADDING_BYTE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = DecodeStunMsg(NewStunReaderFromBytes(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := NewBindingResult(msg)
+	assert(t, result.XorMappedAddr.Equal(NewStunAddr(ip, 3478)), "xor-mapped-address error!")
+	assert(t, result.OtherAddr.Equal(NewStunAddr(ip, 3479)), "other-address error!")
 }
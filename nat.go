@@ -0,0 +1,234 @@
+// nat.go
+// This file describe the NAT behavior discovery of RFC 5780,
+// see readme.md for the sequence of tests.
+//
+package instun
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ERROR_NO_OTHER_ADDRESS = errors.New("InStun: server doesn't support OTHER-ADDRESS")
+	ERROR_NO_MAPPED_ADDRESS = errors.New("InStun: no mapped address in response")
+	ERROR_PADDING_STEP = errors.New("InStun: padding step must be positive")
+)
+
+const (
+	// MAX_PADDING leaves room in a UDP datagram of 65507 bytes
+	// for the header and the other attributes of the response
+	MAX_PADDING = 65000
+)
+
+type NatBehavior int
+
+const (
+	NAT_UNKNOWN NatBehavior = iota
+	NAT_ENDPOINT_INDEPENDENT
+	NAT_ADDRESS_DEPENDENT
+	NAT_ADDRESS_PORT_DEPENDENT
+)
+
+func (behavior NatBehavior) String() string {
+	switch behavior {
+	case NAT_ENDPOINT_INDEPENDENT:
+		return "endpoint-independent"
+	case NAT_ADDRESS_DEPENDENT:
+		return "address-dependent"
+	case NAT_ADDRESS_PORT_DEPENDENT:
+		return "address-and-port-dependent"
+	}
+	return "unknown"
+}
+
+type NatReport struct {
+	// Nat is false if the mapped address equals the local address
+	Nat        bool
+	LocalAddr  *StunAddr
+	MappedAddr *StunAddr
+	OtherAddr  *StunAddr
+	Mapping    NatBehavior
+	Filtering  NatBehavior
+	// Hairpinning is true if the NAT loops back what is
+	// sent from inside to the mapped address
+	Hairpinning bool
+}
+
+// DiscoverNat runs the mapping and filtering behavior tests
+// against the server of client, which must run over UDP
+func (client *Client) DiscoverNat() (*NatReport, error) {
+	server, ok := client.server.(*net.UDPAddr)
+	if client.conn == nil || !ok {
+		return nil, ERROR_UDP_ONLY
+	}
+	report := &NatReport{}
+
+	// Test1: primary ip and port
+	result, err := client.Binding()
+	if err != nil {
+		return nil, err
+	}
+	report.MappedAddr = result.Mapped()
+	if report.MappedAddr == nil {
+		return nil, ERROR_NO_MAPPED_ADDRESS
+	}
+	if result.OtherAddr == nil {
+		return nil, ERROR_NO_OTHER_ADDRESS
+	}
+	report.OtherAddr = result.OtherAddr
+	report.LocalAddr = client.localAddress()
+	report.Nat = !report.MappedAddr.Equal(report.LocalAddr)
+
+	if report.Mapping, err = client.mappingBehavior(report, server); err != nil {
+		return nil, err
+	}
+	if report.Filtering, err = client.filteringBehavior(); err != nil {
+		return nil, err
+	}
+	if report.Hairpinning, err = client.Hairpinning(report.MappedAddr); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Hairpinning sends a Binding request from a second local socket
+// to mapped, the mapped address of the client, and tells if it
+// loops back to the client, see RFC 5780 section 4.5. A NAT which
+// doesn't hairpin is only told by a timeout, so the test takes
+// client.HairpinTimeout then, 0 means the whole retransmissions.
+func (client *Client) Hairpinning(mapped *StunAddr) (bool, error) {
+	if client.conn == nil {
+		return false, ERROR_UDP_ONLY
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false, err
+	}
+	sender := NewClient(conn, nil)
+	defer sender.Close()
+
+	// The request comes to the client as if it were from another
+	// host, and is taken for the response of the transaction
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	to := &net.UDPAddr{IP: mapped.IP, Port: mapped.Port}
+	waits := client.timeouts()
+	if client.HairpinTimeout > 0 {
+		waits = client.timeoutsWithin(client.HairpinTimeout)
+	}
+	_, _, err = client.transactionVia(sender, msg, nil, to, waits)
+	if err == ERROR_TIMEOUT {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (client *Client) mappingBehavior(report *NatReport, server *net.UDPAddr) (NatBehavior, error) {
+	if !report.Nat {
+		return NAT_ENDPOINT_INDEPENDENT, nil
+	}
+
+	// Test2: alternate ip and primary port
+	result, err := client.BindingTo(&net.UDPAddr{
+		IP:   report.OtherAddr.IP,
+		Port: server.Port,
+	})
+	if err != nil {
+		return NAT_UNKNOWN, err
+	}
+	mapped2 := result.Mapped()
+	if mapped2 == nil {
+		return NAT_UNKNOWN, ERROR_NO_MAPPED_ADDRESS
+	}
+	if mapped2.Equal(report.MappedAddr) {
+		return NAT_ENDPOINT_INDEPENDENT, nil
+	}
+
+	// Test3: alternate ip and port
+	result, err = client.BindingTo(&net.UDPAddr{
+		IP:   report.OtherAddr.IP,
+		Port: report.OtherAddr.Port,
+	})
+	if err != nil {
+		return NAT_UNKNOWN, err
+	}
+	mapped3 := result.Mapped()
+	if mapped3 == nil {
+		return NAT_UNKNOWN, ERROR_NO_MAPPED_ADDRESS
+	}
+	if mapped3.Equal(mapped2) {
+		return NAT_ADDRESS_DEPENDENT, nil
+	}
+	return NAT_ADDRESS_PORT_DEPENDENT, nil
+}
+
+func (client *Client) filteringBehavior() (NatBehavior, error) {
+	// Test2: change ip and port
+	_, err := client.BindingTo(nil, NewStunAttr(STUN_ATTR_CHANGE_REQ,
+		&ChangeRequest{IP: true, Port: true}))
+	if err == nil {
+		return NAT_ENDPOINT_INDEPENDENT, nil
+	}
+	if err != ERROR_TIMEOUT {
+		return NAT_UNKNOWN, err
+	}
+
+	// Test3: change port
+	_, err = client.BindingTo(nil, NewStunAttr(STUN_ATTR_CHANGE_REQ,
+		&ChangeRequest{Port: true}))
+	if err == nil {
+		return NAT_ADDRESS_DEPENDENT, nil
+	}
+	if err != ERROR_TIMEOUT {
+		return NAT_UNKNOWN, err
+	}
+	return NAT_ADDRESS_PORT_DEPENDENT, nil
+}
+
+// ProbePadding sends Binding requests padded with step, 2*step...
+// up to max bytes, which the server pads its responses with as well,
+// and returns the largest padding that made it through the NAT both
+// ways. It stops at the first size timing out, as a NAT dropping
+// fragments would do. max is clamped to MAX_PADDING. An unpadded
+// Binding goes first, so a server not answering is an error, while
+// 0 means even step bytes don't make it through.
+func (client *Client) ProbePadding(step, max int) (int, error) {
+	if client.conn == nil {
+		return 0, ERROR_UDP_ONLY
+	}
+	if step <= 0 {
+		return 0, ERROR_PADDING_STEP
+	}
+	if max > MAX_PADDING {
+		max = MAX_PADDING
+	}
+	if _, err := client.BindingTo(nil); err != nil {
+		return 0, err
+	}
+	largest := 0
+	for size := step; size <= max; size += step {
+		_, err := client.BindingTo(nil, NewStunAttr(STUN_ATTR_PADDING, make([]byte, size)))
+		if err == ERROR_TIMEOUT {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		largest = size
+	}
+	return largest, nil
+}
+
+// localAddress returns the address the client socket sends from,
+// resolving the outgoing interface if the socket is bound to any
+func (client *Client) localAddress() *StunAddr {
+	laddr := client.conn.LocalAddr().(*net.UDPAddr)
+	ip := laddr.IP
+	if ip == nil || ip.IsUnspecified() {
+		if conn, err := net.Dial("udp", client.server.String()); err == nil {
+			ip = conn.LocalAddr().(*net.UDPAddr).IP
+			conn.Close()
+		}
+	}
+	return NewStunAddr(normalizeIP(ip), laddr.Port)
+}
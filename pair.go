@@ -5,164 +5,477 @@
 package instun
 
 import (
-	"flag"
-	"net"
-	"strconv"
-	"strings"
-	"encoding/binary"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"log"
+	"net"
+	"strconv"
+	"sync"
 	"time"
-	"errors"
 )
 
-var (
-	FlagAlternate = flag.Bool("A", false,
-	"if this flag exist, the server run as a alternate server")
-	FlagIP = flag.String("-ip", "192.168.1.113",
-	"the ip address of the primary server")
-	FlagPort = flag.Int("-port", 3478,
-	"the primary port for primay server")
-	FlagAlternateIP = flag.String("-alterip", "192.168.1.114",
-	"the ip address of the alternate server")
-	FlagAlternatePort = flag.Int("-alterport", 3479,
-	"the alternate port")
-	FlagCommunicateIP = flag.String("-commip", "192.168.1.113",
-	"the primary ip for communication, LAN IP recommended")
-	FlagCommunicatePort = flag.Int("-commport", 1346,
-	"the port for primay and alternate to communicate\n" +
-	"this port is the port primay server listen on")
+const (
+	STUN_DEFAULT_PORT = 3478
+	STUN_DEFAULT_ALTERNATE_PORT = 3479
+	STUN_DEFAULT_TLS_PORT = 5349 // TLS and DTLS
+	PAIR_DEFAULT_PORT = 1346
+	PAIR_RECONNECT_INTERVAL = time.Second
+	PAIR_RECONNECT_MAX = time.Minute
 )
 
-var (
-	comm net.Conn
-	connect = make(chan bool)
+// The data frames of the link carry the client IP (16 bytes),
+// the client port, the local port to respond from, and then
+// the response
+const (
+	ALTERNATE_HEADER_SIZE = 20
+)
 
+var (
 	ERROR_ALTERNATE_SERVER_NOT_RUNNING = errors.New("Alternate server not running")
+	ERROR_NO_CONFIG = errors.New("InStun: no config.")
+	ERROR_NO_ADDRESS = errors.New("InStun: no primary or alternate address.")
 )
 
-func init() {
-	if !flag.Parsed() {
-		flag.Parse()
+// Config holds the addresses of a stun-pair, the primary and the
+// alternate server share the same one. IPv6 addresses are optional.
+type Config struct {
+	// The primary server
+	IP   net.IP
+	IP6  net.IP
+	Port int
+	// The alternate server
+	AlternateIP   net.IP
+	AlternateIP6  net.IP
+	AlternatePort int
+	// The primary listens on it for the alternate
+	// to connect, LAN IP recommended
+	CommunicateIP   net.IP
+	CommunicatePort int
+	// Secret authenticates the link between the pair
+	Secret []byte
+	// Heartbeat is how often the pair ping each other,
+	// LINK_HEARTBEAT_INTERVAL if it is 0
+	Heartbeat time.Duration
+}
+
+// NewConfig returns a config of the default ports
+func NewConfig(ip, alternateIP net.IP) *Config {
+	return &Config{
+		IP:              ip,
+		Port:            STUN_DEFAULT_PORT,
+		AlternateIP:     alternateIP,
+		AlternatePort:   STUN_DEFAULT_ALTERNATE_PORT,
+		CommunicateIP:   ip,
+		CommunicatePort: PAIR_DEFAULT_PORT,
 	}
+}
 
-	if *FlagAlternate {
-		log.Print("Connecting to primary server...")
-		priAddr, err := net.ResolveTCPAddr("tcp4", *FlagIP+ ":" + strconv.Itoa(*FlagCommunicatePort))
-		if err != nil {
-			panic("Primary server address error!")
-		}
-		comm, err = net.DialTCP("tcp4", nil, priAddr)
-		if err != nil {
-			panic("When alternate server want to connect to primay, " +
-			"an error occur:" + err.Error())
-		}
-		log.Println("OK")
-		/*go*/ alterHandler(comm)
-	} else {
-		lAddr, err := net.ResolveTCPAddr("tcp4", *FlagCommunicateIP+ ":" + strconv.Itoa(*FlagCommunicatePort))
-		if err != nil {
-			panic("When primary server want to listen on communication, " +
-				"an error occur:" + err.Error())
-		}
-		listener, err := net.ListenTCP("tcp4", lAddr)
-		log.Println("Listen for alternate server connect...")
-		go func () {
-			for {
-				conn, err := listener.Accept()
+func (config *Config) communicateAddr() string {
+	return net.JoinHostPort(ipEmptyString(config.CommunicateIP),
+		strconv.Itoa(config.CommunicatePort))
+}
+
+// dialPrimary connects the alternate server to the primary,
+// from the alternate address the primary accepts
+func (config *Config) dialPrimary() (*linkConn, error) {
+	dialer := &net.Dialer{}
+	if ip := config.alternateIP(config.CommunicateIP); ip != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	conn, err := dialer.Dial("tcp", config.communicateAddr())
+	if err != nil {
+		return nil, err
+	}
+	comm, err := newLinkConn(conn, config.Secret, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return comm, nil
+}
+
+// sameFamily returns ip4 if ip is an IPv4 address, ip6 otherwise,
+// nil if it is not set
+func sameFamily(ip, ip4, ip6 net.IP) net.IP {
+	if ip.To4() == nil {
+		ip4 = ip6
+	}
+	if ip4 == nil {
+		return nil
+	}
+	return normalizeIP(ip4)
+}
+
+// primaryIP returns the address of the primary server
+// in the family of ip, nil if it has no such an address
+func (config *Config) primaryIP(ip net.IP) net.IP {
+	return sameFamily(ip, config.IP, config.IP6)
+}
+
+// alternateIP returns the address of the alternate server
+// in the family of ip, nil if it has no such an address
+func (config *Config) alternateIP(ip net.IP) net.IP {
+	return sameFamily(ip, config.AlternateIP, config.AlternateIP6)
+}
+
+// otherPort returns the port of the pair which is not port
+func (config *Config) otherPort(port int) int {
+	if port == config.Port {
+		return config.AlternatePort
+	}
+	return config.Port
+}
+
+func (config *Config) heartbeat() time.Duration {
+	if config.Heartbeat > 0 {
+		return config.Heartbeat
+	}
+	return LINK_HEARTBEAT_INTERVAL
+}
+
+// isAlternate tells if ip is an address of the alternate server
+func (config *Config) isAlternate(ip net.IP) bool {
+	return ip.Equal(config.AlternateIP) || ip.Equal(config.AlternateIP6)
+}
+
+// pairLink is the TCP connection between the primary and the
+// alternate server, it is up while the heartbeats go through
+type pairLink struct {
+	config *Config
+	mutex  sync.Mutex
+	comm   *linkConn
+	closed bool // by Shutdown
+}
+
+func (link *pairLink) conn() *linkConn {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	return link.comm
+}
+
+// setConn makes comm the connection, false if
+// the link is closed, which closes comm
+func (link *pairLink) setConn(comm *linkConn) bool {
+	link.mutex.Lock()
+	if link.closed {
+		link.mutex.Unlock()
+		comm.Close()
+		return false
+	}
+	if link.comm != nil && link.comm != comm {
+		link.comm.Close()
+	}
+	link.comm = comm
+	link.mutex.Unlock()
+	log.Println("Pair link up.")
+	go comm.heartbeat(link.config.heartbeat())
+	return true
+}
+
+func (link *pairLink) isClosed() bool {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	return link.closed
+}
+
+// drop forgets comm if it is still the connection,
+// the alternate server has to reconnect
+func (link *pairLink) drop(comm *linkConn) {
+	link.mutex.Lock()
+	if link.comm == comm {
+		link.comm = nil
+		log.Println("Pair link down.")
+	}
+	link.mutex.Unlock()
+	comm.Close()
+}
+
+// close closes the connection for good
+func (link *pairLink) close() {
+	link.mutex.Lock()
+	comm := link.comm
+	link.comm = nil
+	link.closed = true
+	link.mutex.Unlock()
+	if comm != nil {
+		comm.Close()
+	}
+}
+
+// up tells if the other server can be relied on
+func (link *pairLink) up() bool {
+	comm := link.conn()
+	return comm != nil && comm.alive(link.config.heartbeat())
+}
+
+// PairStatus tells if the link to the other server of the pair
+// is up, and the round trip time of the last heartbeat
+func (stun *Stun) PairStatus() (bool, time.Duration) {
+	if stun.link == nil || !stun.link.up() {
+		return false, 0
+	}
+	if comm := stun.link.conn(); comm != nil {
+		return true, comm.RTT()
+	}
+	return false, 0
+}
+
+// StartPrimary listens on the communication address of the
+// config for the alternate server to connect
+func (stun *Stun) StartPrimary() error {
+	if stun.Config == nil {
+		return ERROR_NO_CONFIG
+	}
+	if len(stun.Config.Secret) == 0 {
+		return ERROR_NO_SECRET
+	}
+	listener, err := net.Listen("tcp", stun.Config.communicateAddr())
+	if err != nil {
+		return err
+	}
+	if !stun.addListener(listener) {
+		listener.Close()
+		return ERROR_SERVER_CLOSED
+	}
+	link := &pairLink{config: stun.Config}
+	stun.link = link
+
+	log.Println("Listen for alternate server connect...")
+	go func () {
+		defer stun.removeListener(listener)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				debug(err)
+				return
+			}
+
+			ip := conn.RemoteAddr().(*net.TCPAddr).IP
+			if !stun.Config.isAlternate(ip) {
+				go conn.Close()
+				continue
+			}
+
+			go func () {
+				comm, err := newLinkConn(conn, stun.Config.Secret, true)
 				if err != nil {
-					debug(err)
-					continue
+					log.Println("Alternate server refused:", err)
+					conn.Close()
+					return
+				}
+				log.Println("Alternate server connected.")
+				if !link.setConn(comm) { // a reconnect replaces the old one
+					return
 				}
+				stun.linkHandler(comm)
+				link.drop(comm)
+			} ()
+		}
+	} ()
+	return nil
+}
+
+// StartAlternate connects to the primary server, the alternate
+// server then answers Binding requests on its own addresses, and
+// the primary and the alternate send responses for each other.
+// The link is reconnected if it breaks.
+func (stun *Stun) StartAlternate() error {
+	if stun.Config == nil {
+		return ERROR_NO_CONFIG
+	}
+	if len(stun.Config.Secret) == 0 {
+		return ERROR_NO_SECRET
+	}
+	log.Print("Connecting to primary server...")
+	comm, err := stun.Config.dialPrimary()
+	if err != nil {
+		return err
+	}
+	log.Println("OK")
+	link := &pairLink{config: stun.Config}
+	link.setConn(comm)
+	stun.alternate = true
+	stun.link = link
 
-				t := strings.Split(conn.RemoteAddr().String(), ":")
-				if t[0] != *FlagAlternateIP {
-					go conn.Close()
-					continue
+	go func () {
+		for {
+			stun.linkHandler(comm)
+			link.drop(comm)
+
+			// Re-connect, backing off up to PAIR_RECONNECT_MAX,
+			// until the server is shut down
+			wait := PAIR_RECONNECT_INTERVAL
+			for !link.isClosed() {
+				if comm, err = stun.Config.dialPrimary(); err == nil {
+					break
+				}
+				log.Println("When alternate server want to re-connect to primay, " +
+					"an error occur:" + err.Error())
+				time.Sleep(wait)
+				if wait *= 2; wait > PAIR_RECONNECT_MAX {
+					wait = PAIR_RECONNECT_MAX
 				}
+			}
+			if comm == nil || !link.setConn(comm) {
+				return
+			}
+		}
+	} ()
+	return nil
+}
 
-				log.Println("Alternate server connected.")
-				comm = conn
-				<- connect // wait for close and reconnect
+// StartSingle runs both servers of the config in this one, for a
+// host which has the primary and the alternate addresses. There is
+// no link, responses for CHANGE-REQUEST go out of the local socket
+// of the other address or port.
+func (stun *Stun) StartSingle() error {
+	if stun.Config == nil {
+		return ERROR_NO_CONFIG
+	}
+	if stun.Config.IP == nil || stun.Config.AlternateIP == nil {
+		return ERROR_NO_ADDRESS
+	}
+	stun.single = true
+	return nil
+}
+
+// onAlternate tells if lip is an address of the alternate server,
+// in single mode it may be either
+func (stun *Stun) onAlternate(lip net.IP) bool {
+	if stun.single {
+		return stun.Config.isAlternate(lip)
+	}
+	return stun.alternate
+}
+
+// localIP returns the address of this server in the family of ip
+func (stun *Stun) localIP(ip net.IP) net.IP {
+	if stun.alternate {
+		return stun.Config.alternateIP(ip)
+	}
+	return stun.Config.primaryIP(ip)
+}
+
+// ListenUDP listens on the addresses of this server of the pair,
+// at both ports, and serves the sockets in the background. In
+// single mode it listens on the addresses of both servers.
+func (stun *Stun) ListenUDP() error {
+	if stun.Config == nil {
+		return ERROR_NO_CONFIG
+	}
+	ips := []net.IP{stun.Config.IP, stun.Config.IP6}
+	if stun.alternate {
+		ips = []net.IP{stun.Config.AlternateIP, stun.Config.AlternateIP6}
+	} else if stun.single {
+		ips = append(ips, stun.Config.AlternateIP, stun.Config.AlternateIP6)
+	}
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		for _, port := range []int{stun.Config.Port, stun.Config.AlternatePort} {
+			if _, err := stun.listenUDP(ip, port); err != nil {
+				return err
 			}
-		} ()
+		}
 	}
+	return nil
 }
 
-func alterHandler(comm net.Conn) {
-	buff := make([]byte, 1024)
-START:
+// otherIP returns the address of the other server than the one
+// of lip, in the family of rip
+func (stun *Stun) otherIP(lip, rip net.IP) net.IP {
+	if stun.onAlternate(lip) {
+		return stun.Config.primaryIP(rip)
+	}
+	return stun.Config.alternateIP(rip)
+}
+
+// otherAddress returns the OTHER-ADDRESS of a request received on
+// lip and lport from a client at rip, that is the address of the
+// other server and the other port, nil if the other server isn't
+// running
+func (stun *Stun) otherAddress(lip, rip net.IP, lport int) *StunAddr {
+	if stun.Config == nil {
+		return nil
+	}
+	if !stun.single && (stun.link == nil || !stun.link.up()) {
+		return nil
+	}
+	ip := stun.otherIP(lip, rip)
+	if ip == nil {
+		return nil
+	}
+	return NewStunAddr(ip, stun.Config.otherPort(lport))
+}
+
+// linkHandler sends the responses the other server asks for,
+// from the local address of the same port
+func (stun *Stun) linkHandler(comm *linkConn) {
+	buff := make([]byte, MAX_PACKET_SIZE)
 	// Usually udp is fast so I use no queue
 	for n, e := comm.Read(buff); e == nil; n, e = comm.Read(buff) {
-		if n < 8 {
+		if n < ALTERNATE_HEADER_SIZE {
 			continue
 		}
 		reader := bytes.NewReader(buff[:n])
-		rip := make(net.IP, 4)
+		rip := make(net.IP, net.IPv6len)
 		var lport, rport uint16
 		reader.Read(rip)
 		binary.Read(reader, binary.BigEndian, &rport)
 		binary.Read(reader, binary.BigEndian, &lport)
 
-		laddr, err := net.ResolveUDPAddr("udp4", *FlagAlternateIP+ ":" + strconv.Itoa(int(lport)))
-		if err != nil {
-			debug(err)
-			continue
-		}
-		raddr, err := net.ResolveUDPAddr("udp4", rip.String() + ":" + strconv.Itoa(int(rport)))
-		if err != nil {
-			debug(err)
-			continue
-		}
-
-		dst, err := net.DialUDP("udp4", laddr, raddr)
-		if err != nil {
-			debug(err)
+		lip := stun.localIP(rip)
+		if lip == nil {
+			debug("pair: no address for", rip)
 			continue
 		}
-		if _, err = dst.Write(buff[8:n]); err != nil {
+		raddr := &net.UDPAddr{IP: normalizeIP(rip), Port: int(rport)}
+		if err := stun.sendFrom(lip, int(lport), raddr, buff[ALTERNATE_HEADER_SIZE:n]); err != nil {
 			debug(err)
-			continue
 		}
 	}
-	comm.Close()
+}
 
-RECONNECT:
-	priAddr, err := net.ResolveTCPAddr("tcp4", *FlagIP+ ":" + strconv.Itoa(*FlagCommunicatePort))
-	if err != nil {
-		// Impossible go here
-		panic("You are fucking my program???")
-	}
-	// Re-connect
-	comm, err = net.DialTCP("tcp4", nil, priAddr)
+// sendFrom sends b to raddr from the UDP socket served on lip
+// and lport, which is opened the first time it is needed
+func (stun *Stun) sendFrom(lip net.IP, lport int, raddr *net.UDPAddr, b []byte) error {
+	conn, err := stun.listenUDP(lip, lport)
 	if err != nil {
-		log.Println("When alternate server want to re-connect to primay, " +
-			"an error occur:" + err.Error())
-		time.Sleep(time.Millisecond)
-		goto RECONNECT
+		return err
 	}
-	goto START
+	_, err = conn.WriteToUDP(b, raddr)
+	return err
 }
 
+// AlternateConn sends responses from the other server of the
+// pair, through the link between them
 type AlternateConn struct {
-	rip net.IP // IPv4
+	link *pairLink // nil if there is no other server
+	lip net.IP // the address of the other server
+	rip net.IP // IPv4 or IPv6
 	rport uint16
 	lport uint16
 }
 
 func (ac *AlternateConn) Write(b []byte) (int, error) {
-	buff := make([]byte, 8)
-	copy(buff, ac.rip.To4())
-	binary.BigEndian.PutUint16(buff[4:], ac.rport)
-	binary.BigEndian.PutUint16(buff[6:], ac.lport)
+	buff := make([]byte, ALTERNATE_HEADER_SIZE)
+	copy(buff, ac.rip.To16())
+	binary.BigEndian.PutUint16(buff[16:], ac.rport)
+	binary.BigEndian.PutUint16(buff[18:], ac.lport)
+
+	var comm *linkConn
+	if ac.link != nil && ac.link.up() {
+		comm = ac.link.conn()
+	}
 	if comm == nil {
 		log.Println(ERROR_ALTERNATE_SERVER_NOT_RUNNING)
 		return 0, ERROR_ALTERNATE_SERVER_NOT_RUNNING
 	}
 	if n, e := comm.Write(append(buff, b...)); e != nil {
 		log.Println(ERROR_ALTERNATE_SERVER_NOT_RUNNING)
-		comm = nil
-		connect <- true // Re-accept, alternate server need reconnect
+		ac.link.drop(comm) // alternate server need reconnect
 		return 0, ERROR_ALTERNATE_SERVER_NOT_RUNNING
 	} else {
 		return n, nil
@@ -177,12 +490,13 @@ func (ac *AlternateConn) Close() error {
 	return nil
 }
 
+// LocalAddr is where the other server responds from
 func (ac *AlternateConn) LocalAddr() net.Addr {
-	return nil
+	return &net.UDPAddr{IP: ac.lip, Port: int(ac.lport)}
 }
 
 func (ac *AlternateConn) RemoteAddr() net.Addr {
-	return nil
+	return &net.UDPAddr{IP: ac.rip, Port: int(ac.rport)}
 }
 
 func (ac *AlternateConn) SetDeadline(t time.Time) error {
@@ -196,4 +510,3 @@ func (ac *AlternateConn) SetReadDeadline(t time.Time) error {
 func (ac *AlternateConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
-
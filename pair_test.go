@@ -0,0 +1,483 @@
+package instun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenSamePort listens on a port which is free on both ip1 and ip2
+func listenSamePort(t *testing.T, ip1, ip2 net.IP) (*net.UDPConn, *net.UDPConn) {
+	for i := 0; i < 10; i++ {
+		conn1, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn1.LocalAddr().(*net.UDPAddr).Port
+		conn2, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip2, Port: port})
+		if err == nil {
+			return conn1, conn2
+		}
+		conn1.Close()
+	}
+	t.Fatal("no free port")
+	return nil, nil
+}
+
+// secondIP returns 127.0.0.2 for the alternate server, the
+// test is skipped if it can't be bound, as on hosts where only
+// 127.0.0.1 is routed to the loopback interface
+func secondIP(t *testing.T) net.IP {
+	ip := net.IPv4(127, 0, 0, 2).To4()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skip("a second loopback address is needed, 127.0.0.2 cannot be bound:", err)
+	}
+	conn.Close()
+	return ip
+}
+
+// secondIP6 returns an IPv6 address of the host besides ::1 for the
+// alternate server, the test is skipped if there is none
+func secondIP6(t *testing.T) net.IP {
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() != nil || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: ipnet.IP}); err == nil {
+			conn.Close()
+			return ipnet.IP
+		}
+	}
+	t.Skip("a second IPv6 address is needed besides ::1")
+	return nil
+}
+
+// startPair runs a primary server on 127.0.0.1 and an alternate
+// one on 127.0.0.2, both at two ports, until the test ends
+func startPair(t *testing.T) (*Config, *Stun, *Stun) {
+	primaryIP := net.IPv4(127, 0, 0, 1).To4()
+	return startPairOn(t, NewConfig(primaryIP, secondIP(t)), primaryIP)
+}
+
+// startPairOn runs the pair of config on primaryIP and the alternate
+// address of its family, both at two ports, until the test ends
+func startPairOn(t *testing.T, config *Config, primaryIP net.IP) (*Config, *Stun, *Stun) {
+	alternateIP := config.alternateIP(primaryIP)
+	primary1, alternate1 := listenSamePort(t, primaryIP, alternateIP)
+	primary2, alternate2 := listenSamePort(t, primaryIP, alternateIP)
+	comm, err := net.ListenTCP("tcp", &net.TCPAddr{IP: primaryIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	comm.Close()
+
+	config.Port = primary1.LocalAddr().(*net.UDPAddr).Port
+	config.AlternatePort = primary2.LocalAddr().(*net.UDPAddr).Port
+	config.CommunicatePort = comm.Addr().(*net.TCPAddr).Port
+	config.Secret = []byte("secret")
+
+	primary := NewStun(config)
+	t.Cleanup(func() { primary.Shutdown(context.Background()) })
+	if err := primary.StartPrimary(); err != nil {
+		t.Fatal(err)
+	}
+	go primary.RunUDP(primary1)
+	go primary.RunUDP(primary2)
+	alternate := NewStun(config)
+	t.Cleanup(func() { alternate.Shutdown(context.Background()) })
+	if err := alternate.StartAlternate(); err != nil {
+		t.Fatal(err)
+	}
+	go alternate.RunUDP(alternate1)
+	go alternate.RunUDP(alternate2)
+
+	for i := 0; !primary.link.up(); i++ {
+		if i > 100 {
+			t.Fatal("alternate server not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return config, primary, alternate
+}
+
+func TestStun_StartPrimary(t *testing.T) {
+	config, _, _ := startPair(t)
+
+	client, err := Dial("udp", NewStunAddr(config.IP, config.Port).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+
+	result, err := client.Binding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := NewStunAddr(config.AlternateIP, config.AlternatePort)
+	assert(t, result.OtherAddr.Equal(other), "other-address error!")
+
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_CHANGE_REQ, &ChangeRequest{IP: true, Port: true}))
+	rmsg, from, err := client.Request(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, from.String() == other.String(), "response not from the alternate server!")
+	result = NewBindingResult(rmsg)
+	assert(t, result.ResponseOrigin.Equal(other), "response-origin error!")
+
+	msg = NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_CHANGE_REQ, &ChangeRequest{Port: true}))
+	rmsg, from, err = client.Request(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := NewStunAddr(config.IP, config.AlternatePort)
+	assert(t, from.String() == changed.String(), "response not from the alternate port!")
+	result = NewBindingResult(rmsg)
+	assert(t, result.ResponseOrigin.Equal(changed), "response-origin error!")
+}
+
+func TestStun_StartAlternate(t *testing.T) {
+	config, _, _ := startPair(t)
+
+	client, err := Dial("udp", NewStunAddr(config.IP, config.Port).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+
+	// The alternate server answers on both ports
+	for _, port := range []int{config.Port, config.AlternatePort} {
+		to := &net.UDPAddr{IP: config.AlternateIP, Port: port}
+		result, err := client.BindingTo(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, result.ResponseOrigin.Equal(NewStunAddr(to.IP, to.Port)),
+			"response-origin error!")
+		assert(t, result.OtherAddr.Equal(NewStunAddr(config.IP, config.otherPort(port))),
+			"other-address error!")
+	}
+
+	// and relays CHANGE-REQUEST to the primary server
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_CHANGE_REQ, &ChangeRequest{IP: true}))
+	to := &net.UDPAddr{IP: config.AlternateIP, Port: config.AlternatePort}
+	_, from, err := client.Request(msg, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := NewStunAddr(config.IP, config.AlternatePort)
+	assert(t, from.String() == primary.String(), "response not from the primary server!")
+}
+
+func TestClient_DiscoverNat(t *testing.T) {
+	config, _, _ := startPair(t)
+
+	client, err := Dial("udp4", NewStunAddr(config.IP, config.Port).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+	client.Rc = 3
+
+	report, err := client.DiscoverNat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, !report.Nat, "nat detected on loopback!")
+	assert(t, report.Mapping == NAT_ENDPOINT_INDEPENDENT, "mapping: " + report.Mapping.String())
+	assert(t, report.Filtering == NAT_ENDPOINT_INDEPENDENT, "filtering: " + report.Filtering.String())
+	assert(t, report.Hairpinning, "no hairpinning on loopback!")
+}
+
+func TestClient_Hairpinning(t *testing.T) {
+	// No server is needed, nothing is sent to it
+	client, err := Dial("udp4", listenPeer(t).LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 20 * time.Millisecond
+	client.Rc = 2
+	client.Rm = 2
+
+	local := client.LocalAddr().(*net.UDPAddr)
+	hairpin, err := client.Hairpinning(NewStunAddr(net.IPv4(127, 0, 0, 1), local.Port))
+	assert(t, err == nil && hairpin, "no hairpinning to the client itself!")
+
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	hairpin, err = client.Hairpinning(NewStunAddr(net.IPv4(127, 0, 0, 1),
+		closed.LocalAddr().(*net.UDPAddr).Port))
+	assert(t, err == nil && !hairpin, "hairpinning to nowhere!")
+
+	// which only takes HairpinTimeout, not the retransmissions
+	client.RTO, client.Rc, client.Rm = STUN_RTO, STUN_RC, STUN_RM
+	client.HairpinTimeout = 100 * time.Millisecond
+	start := time.Now()
+	hairpin, err = client.Hairpinning(NewStunAddr(net.IPv4(127, 0, 0, 1),
+		closed.LocalAddr().(*net.UDPAddr).Port))
+	assert(t, err == nil && !hairpin && time.Since(start) < time.Second, "hairpinning timeout error!")
+	client.RTO, client.Rc, client.Rm = 20*time.Millisecond, 2, 2
+
+	// A handler set meanwhile is kept, and sees no looped request
+	handled := make(chan []byte, 4)
+	done := make(chan struct{})
+	go func () {
+		client.Hairpinning(NewStunAddr(net.IPv4(127, 0, 0, 1), local.Port))
+		client.Hairpinning(NewStunAddr(net.IPv4(127, 0, 0, 1),
+			closed.LocalAddr().(*net.UDPAddr).Port))
+		close(done)
+	} ()
+	time.Sleep(30 * time.Millisecond)
+	client.SetHandler(func(data []byte, from net.Addr) { handled <- data })
+	<-done
+	assert(t, len(handled) == 0, "looped request handled!")
+	client.dispatch([]byte("x"), nil)
+	assert(t, len(handled) == 1, "handler replaced by hairpinning!")
+}
+
+func TestStun_StartAlternateSecret(t *testing.T) {
+	config, _, _ := startPair(t)
+
+	wrong := *config
+	wrong.Secret = []byte("wrong")
+	err := NewStun(&wrong).StartAlternate()
+	assert(t, err != nil, "alternate server with a wrong secret connected!")
+
+	wrong.Secret = nil
+	err = NewStun(&wrong).StartAlternate()
+	assert(t, err == ERROR_NO_SECRET, "alternate server without a secret started!")
+}
+
+func TestStun_PairStatus(t *testing.T) {
+	config := NewConfig(net.IPv4(127, 0, 0, 1).To4(), net.IPv4(127, 0, 0, 2).To4())
+	config.Secret = []byte("secret")
+	config.Heartbeat = 100 * time.Millisecond
+	comm, other, err := linkPair(t, config.Secret, config.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer comm.Close()
+	stun := NewStun(config)
+	stun.link = &pairLink{config: config}
+	stun.link.setConn(comm)
+	go stun.linkHandler(comm)
+	go other.Read(make([]byte, MAX_PACKET_SIZE)) // answers pings
+
+	for i := 0; ; i++ {
+		up, rtt := stun.PairStatus()
+		if up && rtt > 0 {
+			break
+		}
+		if i > 500 {
+			t.Fatal("no heartbeat")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, stun.otherAddress(config.IP, config.IP, config.Port) != nil, "other-address error!")
+
+	// The other server is gone, OTHER-ADDRESS is withdrawn
+	other.Close()
+	for i := 0; ; i++ {
+		if up, _ := stun.PairStatus(); !up {
+			break
+		}
+		if i > 500 {
+			t.Fatal("pair link still up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, stun.otherAddress(config.IP, config.IP, config.Port) == nil, "other-address of a down alternate server!")
+}
+
+func TestStun_ListenUDP(t *testing.T) {
+	config, _, alternate := startPair(t)
+
+	// The alternate server sends from one long-lived socket of its
+	// own, which clients can talk to as well
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: config.AlternateIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+	raddr := &net.UDPAddr{IP: config.IP, Port: config.Port}
+	for i := 0; i < 10; i++ {
+		if err := alternate.sendFrom(config.AlternateIP, port, raddr, []byte{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 0
+	alternate.mutex.Lock()
+	for _, conn := range alternate.sockets {
+		if conn.LocalAddr().(*net.UDPAddr).Port == port {
+			count++
+		}
+	}
+	alternate.mutex.Unlock()
+	assert(t, count == 1, "relay sockets leaked!")
+
+	client, err := Dial("udp", NewStunAddr(config.AlternateIP, port).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+	_, err = client.Binding()
+	assert(t, err == nil, "relay socket doesn't serve clients!")
+}
+
+func TestStun_StartSingle(t *testing.T) {
+	primaryIP := net.IPv4(127, 0, 0, 1).To4()
+	alternateIP := secondIP(t)
+	primary1, alternate1 := listenSamePort(t, primaryIP, alternateIP)
+	primary2, alternate2 := listenSamePort(t, primaryIP, alternateIP)
+	config := NewConfig(primaryIP, alternateIP)
+	config.Port = primary1.LocalAddr().(*net.UDPAddr).Port
+	config.AlternatePort = primary2.LocalAddr().(*net.UDPAddr).Port
+	for _, conn := range []*net.UDPConn{primary1, alternate1, primary2, alternate2} {
+		conn.Close()
+	}
+
+	stun := NewStun(config)
+	if err := stun.StartSingle(); err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Shutdown(context.Background())
+	if err := stun.ListenUDP(); err != nil {
+		t.Fatal(err)
+	}
+
+	// All four addresses answer, without any link
+	client, err := Dial("udp4", NewStunAddr(config.IP, config.Port).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 50 * time.Millisecond
+	client.Rc = 3
+
+	report, err := client.DiscoverNat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, report.OtherAddr.Equal(NewStunAddr(alternateIP, config.AlternatePort)), "other-address error!")
+	assert(t, report.Filtering == NAT_ENDPOINT_INDEPENDENT, "filtering: " + report.Filtering.String())
+
+	result, err := client.BindingTo(&net.UDPAddr{IP: alternateIP, Port: config.AlternatePort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, result.OtherAddr.Equal(NewStunAddr(primaryIP, config.Port)), "other-address error!")
+
+	err = NewStun(&Config{IP: primaryIP}).StartSingle()
+	assert(t, err == ERROR_NO_ADDRESS, "single server without an alternate address started!")
+}
+
+func TestStun_ShutdownPair(t *testing.T) {
+	_, primary, alternate := startPair(t)
+
+	// The alternate server leaves the pair for good
+	if err := alternate.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if up, _ := primary.PairStatus(); !up {
+			break
+		}
+		if i > 100 {
+			t.Fatal("pair link still up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	up, _ := alternate.PairStatus()
+	assert(t, !up && alternate.link.conn() == nil, "alternate server reconnected after shutdown!")
+}
+
+func TestStun_PairIPv6(t *testing.T) {
+	loopback := net.ParseIP("::1")
+	config := &Config{IP6: loopback, AlternateIP6: secondIP6(t), CommunicateIP: loopback}
+	config, _, _ = startPairOn(t, config, loopback)
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	local := NewStunAddr(loopback, conn.LocalAddr().(*net.UDPAddr).Port)
+	primary := NewStunAddr(config.IP6, config.Port)
+	alternate := NewStunAddr(config.AlternateIP6, config.AlternatePort)
+
+	for _, cr := range []*ChangeRequest{nil, {IP: true, Port: true}} {
+		msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+		origin := primary
+		if cr != nil {
+			// Relayed through the link with the 16 bytes address
+			msg.AddAttr(NewStunAttr(STUN_ATTR_CHANGE_REQ, cr))
+			origin = alternate
+		}
+		data, _ := msg.Encode(nil, nil, false, PADDING_BYTE)
+		conn.WriteTo(data, &net.UDPAddr{IP: primary.IP, Port: primary.Port})
+
+		buff := make([]byte, MAX_PACKET_SIZE)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rmsg, err := DecodeStunMsg(NewStunReaderFromBytes(buff[:n]), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := NewBindingResult(rmsg)
+		assert(t, NewStunAddr(from.IP, from.Port).Equal(origin), "response from a wrong address!")
+		assert(t, result.XorMappedAddr.Equal(local) && result.XorMappedAddr.IP.To4() == nil, "xor-mapped-address error!")
+		assert(t, result.ResponseOrigin.Equal(origin) && result.ResponseOrigin.IP.To4() == nil, "response-origin error!")
+		assert(t, result.OtherAddr.Equal(alternate), "other-address error!")
+	}
+}
+
+func TestStun_ChangeRequestLinkDown(t *testing.T) {
+	config, primary, alternate := startPair(t)
+
+	// The link goes down, the servers still answer on their own
+	alternate.link.close()
+	for i := 0; ; i++ {
+		if up, _ := primary.PairStatus(); !up {
+			break
+		}
+		if i > 100 {
+			t.Fatal("pair link still up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: config.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, server := range []*net.UDPAddr{
+		{IP: config.IP, Port: config.Port},
+		{IP: config.AlternateIP, Port: config.Port},
+	} {
+		rmsg := changeRequest(t, conn, server, &ChangeRequest{IP: true, Port: true})
+		assert(t, isUnsupportedChange(rmsg), "change-request while the link is down is not rejected!")
+		rmsg = changeRequest(t, conn, server, &ChangeRequest{Port: true})
+		assert(t, rmsg.Class() == STUN_CLASS_SUCCESS_RESP, "change-request of port needs no link!")
+	}
+}
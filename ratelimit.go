@@ -0,0 +1,96 @@
+// ratelimit.go
+// This file describe a stage of the pipeline limiting the requests
+// of each client IP with a token bucket, see Stun.Use.
+//
+package instun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter lets a client IP make Burst requests at once, and one
+// more every Interval. Requests over the limit are dropped, clients
+// over UDP retransmit them later.
+type RateLimiter struct {
+	Burst    int
+	Interval time.Duration
+
+	mutex   sync.Mutex
+	buckets map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens int
+	filled time.Time // when the last token was added
+}
+
+func NewRateLimiter(burst int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		Burst:    burst,
+		Interval: interval,
+		buckets:  make(map[string]*rateBucket),
+	}
+}
+
+// refill adds the tokens earned since the bucket was filled
+func (limiter *RateLimiter) refill(bucket *rateBucket, now time.Time) {
+	if limiter.Interval <= 0 {
+		bucket.tokens = limiter.Burst
+		return
+	}
+	earned := int(now.Sub(bucket.filled) / limiter.Interval)
+	if earned == 0 {
+		return
+	}
+	bucket.filled = bucket.filled.Add(time.Duration(earned) * limiter.Interval)
+	if bucket.tokens += earned; bucket.tokens > limiter.Burst {
+		bucket.tokens = limiter.Burst
+	}
+}
+
+// Allow takes a token of ip, false if there is none left
+func (limiter *RateLimiter) Allow(ip net.IP) bool {
+	now := time.Now()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	// Full buckets are as good as none
+	if now.Sub(limiter.swept) > time.Duration(limiter.Burst) * limiter.Interval {
+		for key, bucket := range limiter.buckets {
+			if limiter.refill(bucket, now); bucket.tokens == limiter.Burst {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.swept = now
+	}
+
+	key := normalizeIP(ip).String()
+	bucket := limiter.buckets[key]
+	if bucket == nil {
+		bucket = &rateBucket{tokens: limiter.Burst, filled: now}
+		limiter.buckets[key] = bucket
+	}
+	limiter.refill(bucket, now)
+	if bucket.tokens == 0 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// Middleware drops the requests of clients over the limit,
+// indications and responses pass
+func (limiter *RateLimiter) Middleware(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, request *Request) {
+		if request.Msg.Class() == STUN_CLASS_REQUEST {
+			ip, _ := getConnRAddress(request.Conn)
+			if !limiter.Allow(ip) {
+				return
+			}
+		}
+		next.ServeSTUN(w, request)
+	})
+}
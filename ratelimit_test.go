@@ -0,0 +1,45 @@
+package instun
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	limiter := NewRateLimiter(2, 50 * time.Millisecond)
+	ip := net.IPv4(127, 0, 0, 1)
+	assert(t, limiter.Allow(ip) && limiter.Allow(ip), "burst refused!")
+	assert(t, !limiter.Allow(ip), "request over the burst allowed!")
+	assert(t, limiter.Allow(net.IPv4(127, 0, 0, 2)), "other client refused!")
+
+	time.Sleep(60 * time.Millisecond)
+	assert(t, limiter.Allow(ip), "token not refilled!")
+	assert(t, !limiter.Allow(ip), "more than a token refilled!")
+}
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	stun := &Stun{}
+	stun.Use(NewRateLimiter(2, time.Hour).Middleware)
+	go stun.RunUDP(listener)
+
+	client, err := Dial("udp4", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.RTO = 20 * time.Millisecond
+	client.Rc = 2
+
+	_, err = client.Binding()
+	assert(t, err == nil, "binding refused!")
+	_, err = client.Binding()
+	assert(t, err == nil, "binding refused!")
+	_, err = client.Binding()
+	assert(t, err == ERROR_TIMEOUT, "binding over the limit answered!")
+}
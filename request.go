@@ -15,10 +15,40 @@ const (
 
 )
 
-func requestHandler(ctx *StunMsgCtx, conn net.Conn, msg *StunMsg) bool {
-	switch msg.Method() {
-	case STUN_METHOD_BINDING:
-		return BindingHandler(ctx, conn, msg)
+func (stun *Stun) requestHandler(ctx *StunMsgCtx, conn net.Conn, msg *StunMsg) bool {
+	if stun.Mux().Handler(msg.Method(), msg.Class()) == nil {
+		return false
 	}
-	return false
+	ctx.fp = msg.PeekAttr(STUN_ATTR_FINGERPRINT) != nil
+	stun.pipeline().ServeSTUN(&responseWriter{ctx: ctx, conn: conn},
+		&Request{Msg: msg, Conn: conn, ctx: ctx})
+	return true
+}
+
+// authenticate checks the credentials of a request, Binding requests
+// use the short-term mechanism if it is set, others the long-term one
+func (stun *Stun) authenticate(w ResponseWriter, request *Request) bool {
+	if request.Msg.Method() == STUN_METHOD_BINDING {
+		if stun.ShortTerm != nil {
+			return stun.ShortTerm.Authenticate(w, request)
+		}
+		if stun.LongTerm != nil && stun.LongTerm.Binding {
+			return stun.LongTerm.Authenticate(w, request)
+		}
+		return true
+	}
+	if stun.LongTerm != nil {
+		return stun.LongTerm.Authenticate(w, request)
+	}
+	return true
+}
+
+// encodeResponse encodes rmsg with the SOFTWARE, the integrity
+// and the fingerprint ctx asks for
+func encodeResponse(ctx *StunMsgCtx, rmsg *StunMsg, ec *ErrorCode) ([]byte, error) {
+	rmsg.AddAttr(NewStunAttr(STUN_ATTR_SOFTWARE, SOFTWARE))
+	if ctx.sha256 {
+		return rmsg.EncodeSHA256(ec, ctx.key, ctx.fp, PADDING_BYTE)
+	}
+	return rmsg.Encode(ec, ctx.key, ctx.fp, PADDING_BYTE)
 }
@@ -0,0 +1,68 @@
+// stream.go
+// This file describe the framing of messages over TCP and TLS. A
+// STUN message is as long as its header says, a ChannelData message
+// is padded to 4 bytes, see RFC 8489 section 6.2.2 and RFC 8656
+// section 12.5. Over DTLS a datagram is a message.
+//
+package instun
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// streamReader splits a stream into messages, whatever
+// segments they come in
+type streamReader struct {
+	reader *bufio.Reader
+}
+
+func newStreamReader(r io.Reader) *streamReader {
+	return &streamReader{reader: bufio.NewReaderSize(r, MAX_PACKET_SIZE)}
+}
+
+// next returns the next message, a ChannelData one without
+// its padding. A stream of something else is broken, and
+// ERROR_BAD_MESSAGE is returned.
+func (stream *streamReader) next() ([]byte, error) {
+	head, err := stream.reader.Peek(CHANNEL_HEADER_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(head[2:]))
+	size, padded := 0, 0
+	switch {
+	case IsChannelData(head):
+		size = CHANNEL_HEADER_LENGTH + length
+		padded = (size + 3) &^ 3
+	case head[0] & 0xc0 == 0:
+		size = STUN_HEADER_LENGTH + length
+		padded = size
+	default:
+		return nil, ERROR_BAD_MESSAGE
+	}
+
+	buff := make([]byte, padded)
+	if _, err := io.ReadFull(stream.reader, buff); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buff[:size], nil
+}
+
+// datagramReader returns the messages of a datagram connection,
+// such as a DTLS one, the buffer is reused by the next call
+func datagramReader(conn net.Conn) func() ([]byte, error) {
+	buff := make([]byte, MAX_PACKET_SIZE)
+	return func() ([]byte, error) {
+		n, err := conn.Read(buff)
+		if err != nil {
+			return nil, err
+		}
+		return buff[:n], nil
+	}
+}
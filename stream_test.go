@@ -0,0 +1,93 @@
+package instun
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// byteReader reads one byte at a time, as if every
+// byte came in a segment of its own
+type byteReader struct {
+	reader io.Reader
+}
+
+func (r *byteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.reader.Read(b)
+}
+
+func TestStreamReader(t *testing.T) {
+	msg1, _ := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid()).Encode(nil, nil, false, PADDING_BYTE)
+	msg := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, NewTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, "user"))
+	msg2, _ := msg.Encode(nil, nil, true, PADDING_BYTE)
+	channel := EncodeChannelData(CHANNEL_MIN, []byte("abcde"), true)
+
+	// Coalesced, and split into bytes
+	stream := append(append(append([]byte{}, msg1...), channel...), msg2...)
+	for _, r := range []io.Reader{bytes.NewReader(stream), &byteReader{bytes.NewReader(stream)}} {
+		reader := newStreamReader(r)
+		for _, want := range [][]byte{msg1, channel[:CHANNEL_HEADER_LENGTH + 5], msg2} {
+			data, err := reader.next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert(t, bytes.Equal(data, want), "stream framing error!")
+		}
+		_, err := reader.next()
+		assert(t, err == io.EOF, "stream end error!")
+	}
+
+	// Cut in the middle, or not a message at all
+	_, err := newStreamReader(bytes.NewReader(msg2[:len(msg2) - 1])).next()
+	assert(t, err == io.ErrUnexpectedEOF, "cut message accepted!")
+	_, err = newStreamReader(bytes.NewReader([]byte{0x80, 0, 0, 0})).next()
+	assert(t, err == ERROR_BAD_MESSAGE, "bad stream accepted!")
+}
+
+func TestStun_ServeStream(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&Stun{}).Run(listener)
+
+	conn, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Two requests in a segment, and one in two
+	var tids [][STUN_TID_SIZE]byte
+	var data []byte
+	for i := 0; i < 3; i++ {
+		tids = append(tids, NewTid())
+		b, _ := NewStunMsg(STUN_METHOD_BINDING, STUN_CLASS_REQUEST, tids[i]).Encode(nil, nil, false, PADDING_BYTE)
+		data = append(data, b...)
+	}
+	half := len(data) * 5 / 6
+	conn.Write(data[:half])
+	time.Sleep(20 * time.Millisecond)
+	conn.Write(data[half:])
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reader := newStreamReader(conn)
+	for i := range tids {
+		b, err := reader.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rmsg, err := DecodeStunMsg(NewStunReaderFromBytes(b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert(t, rmsg.Tid == tids[i], "stream response error!")
+	}
+}
@@ -1,13 +1,16 @@
 package instun
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
 var (
 	ERROR_NIL_READER = errors.New("InStun: nil reader.")
+	ERROR_SERVER_CLOSED = errors.New("InStun: server closed.")
 )
 
 const (
@@ -16,53 +19,357 @@ const (
 	STUN_CLASS_ERROR_RESP = 0x3
 )
 
+const (
+	MAX_PACKET_SIZE = 65536
+)
+
 type Stun struct {
+	// Config is the addresses of the stun-pair,
+	// nil if the server runs alone
+	Config *Config
+	// Turn relays for clients if it is not nil
+	Turn *TurnServer
+	// LongTerm authenticates requests if it is not nil
+	LongTerm *LongTermAuth
+	// ShortTerm authenticates Binding requests if it is not nil
+	ShortTerm *ShortTermAuth
+
+	link *pairLink // set by StartPrimary or StartAlternate
+	alternate bool
+	single bool // set by StartSingle
+
+	mutex sync.Mutex
+	sockets []*net.UDPConn // served by ServeUDP
+	listeners map[net.Listener]struct{}
+	conns map[net.Conn]struct{}
+	closed bool // by Shutdown
+	active int // messages being handled
+	idle chan struct{} // closed when active drops to 0
+
+	muxOnce sync.Once
+	mux *ServeMux
+	middlewares []Middleware
+	custom bool // middlewares are the whole pipeline, see SetPipeline
+	stages Handler // built by pipeline
+}
 
+// NewStun returns a server of config, the link between the pair
+// is started by StartPrimary or StartAlternate, or StartSingle runs
+// both servers in one, config may be nil
+func NewStun(config *Config) *Stun {
+	return &Stun{Config: config}
 }
 
+// Run serves listener until it is closed or the server shut down
 func (stun *Stun) Run(listener net.Listener) error {
+	return stun.Serve(context.Background(), listener)
+}
+
+// RunUDP serves listener until it is closed or the server shut down
+func (stun *Stun) RunUDP(listener *net.UDPConn) error {
+	return stun.ServeUDP(context.Background(), listener)
+}
+
+// Serve accepts connections on listener and serves them, until ctx
+// is done, which closes listener, or the server is shut down. It
+// returns ctx.Err() or ERROR_SERVER_CLOSED then.
+func (stun *Stun) Serve(ctx context.Context, listener net.Listener) error {
+	if !stun.addListener(listener) {
+		return ERROR_SERVER_CLOSED
+	}
+	defer stun.removeListener(listener)
+	defer watch(ctx, listener)()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			return err
+			return stun.serveError(ctx, err)
 		}
+		go stun.serveConn(conn)
+	}
+}
 
-		go func (conn net.Conn) {
-			data := make([]byte, 1024)
-			for {
-				if n, e := conn.Read(data); n > 20 && e == nil {
-					ctx := &StunMsgCtx{}
-					reader := NewStunReaderFromBytes(data[:n])
-					msg, err := DecodeStunMsg(reader, &ctx.ua)
-					if err != nil {
-						continue
-					}
-
-					BindingHandler(ctx, conn, msg)
-				}
-			}
-		} (conn)
+// serveConn serves a TCP, TLS or DTLS connection until
+// the peer closes it
+func (stun *Stun) serveConn(conn net.Conn) {
+	defer conn.Close()
+	if !stun.addConn(conn) {
+		return
+	}
+	defer stun.removeConn(conn)
+	if stun.Turn != nil {
+		defer stun.Turn.closeConn(conn)
+	}
+
+	next := newStreamReader(conn).next
+	if _, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		next = datagramReader(conn)
+	}
+	for {
+		data, err := next()
+		if err != nil {
+			return
+		}
+		if len(data) >= CHANNEL_HEADER_LENGTH && stun.begin() {
+			stun.serve(conn, data)
+			stun.end()
+		}
 	}
 }
 
-func (stun *Stun) RunUDP(listener *net.UDPConn) error {
-	data := make([]byte, 1024)
+// ServeUDP serves listener like Serve, the socket is closed when
+// the server is shut down, after the messages being handled
+func (stun *Stun) ServeUDP(ctx context.Context, listener *net.UDPConn) error {
+	if stun.isClosed() {
+		return ERROR_SERVER_CLOSED
+	}
+	stun.addSocket(listener)
+	defer stun.removeSocket(listener)
+	defer watch(ctx, listener)()
+
+	data := make([]byte, MAX_PACKET_SIZE)
 	for {
-		if n, addr, e := listener.ReadFromUDP(data); n > 20 && e == nil {
+		n, addr, e := listener.ReadFromUDP(data)
+		if errors.Is(e, net.ErrClosed) {
+			return stun.serveError(ctx, e)
+		}
+		if n >= CHANNEL_HEADER_LENGTH && e == nil && stun.begin() {
 			conn := &StunUDP{
 				conn: listener,
 				raddr: addr,
 			}
-			ctx := &StunMsgCtx{}
-			reader := NewStunReaderFromBytes(data[:n])
-			msg, err := DecodeStunMsg(reader, &ctx.ua)
-			if err != nil {
-				continue
-			}
+			stun.serve(conn, data[:n])
+			stun.end()
+		}
+	}
+}
+
+// Shutdown stops the server gracefully: the listeners are closed,
+// the messages being handled are waited for until ctx is done, and
+// then the UDP sockets, the connections, the TURN allocations and
+// the pair link are closed.
+// It returns ctx.Err() if the messages were not done in time.
+func (stun *Stun) Shutdown(ctx context.Context) error {
+	stun.mutex.Lock()
+	stun.closed = true
+	listeners := make([]net.Listener, 0, len(stun.listeners))
+	for listener := range stun.listeners {
+		listeners = append(listeners, listener)
+	}
+	idle := stun.idle
+	if idle == nil && stun.active > 0 {
+		idle = make(chan struct{})
+		stun.idle = idle
+	}
+	stun.mutex.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
 
-			BindingHandler(ctx, conn, msg)
+	var err error
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
 	}
+
+	stun.mutex.Lock()
+	sockets := append([]*net.UDPConn{}, stun.sockets...)
+	conns := make([]net.Conn, 0, len(stun.conns))
+	for conn := range stun.conns {
+		conns = append(conns, conn)
+	}
+	stun.mutex.Unlock()
+
+	for _, conn := range sockets {
+		conn.Close()
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if stun.Turn != nil {
+		stun.Turn.close()
+	}
+	if stun.link != nil {
+		stun.link.close()
+	}
+	return err
+}
+
+func (stun *Stun) isClosed() bool {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	return stun.closed
+}
+
+// begin counts a message being handled,
+// false if the server is shut down
+func (stun *Stun) begin() bool {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	if stun.closed {
+		return false
+	}
+	stun.active++
+	return true
+}
+
+func (stun *Stun) end() {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	if stun.active--; stun.active == 0 && stun.idle != nil {
+		close(stun.idle)
+		stun.idle = nil
+	}
+}
+
+// serveError returns why serving stopped with err
+func (stun *Stun) serveError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if stun.isClosed() {
+		return ERROR_SERVER_CLOSED
+	}
+	return err
+}
+
+// watch closes closer when ctx is done,
+// until the returned function is called
+func watch(ctx context.Context, closer interface{ Close() error }) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func () {
+		select {
+		case <-ctx.Done():
+			closer.Close()
+		case <-stop:
+		}
+	} ()
+	return func() { close(stop) }
+}
+
+func (stun *Stun) addListener(listener net.Listener) bool {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	if stun.closed {
+		return false
+	}
+	if stun.listeners == nil {
+		stun.listeners = make(map[net.Listener]struct{})
+	}
+	stun.listeners[listener] = struct{}{}
+	return true
+}
+
+func (stun *Stun) removeListener(listener net.Listener) {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	delete(stun.listeners, listener)
+}
+
+func (stun *Stun) addConn(conn net.Conn) bool {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	if stun.closed {
+		return false
+	}
+	if stun.conns == nil {
+		stun.conns = make(map[net.Conn]struct{})
+	}
+	stun.conns[conn] = struct{}{}
+	return true
+}
+
+func (stun *Stun) removeConn(conn net.Conn) {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	delete(stun.conns, conn)
+}
+
+// findSocket returns the UDP socket served on ip and port, nil
+// if there is no such a socket, stun.mutex must be held
+func (stun *Stun) findSocket(ip net.IP, port int) *net.UDPConn {
+	for _, conn := range stun.sockets {
+		laddr := conn.LocalAddr().(*net.UDPAddr)
+		if laddr.Port == port && (laddr.IP.IsUnspecified() || laddr.IP.Equal(ip)) {
+			return conn
+		}
+	}
+	return nil
+}
+
+func (stun *Stun) addSocket(conn *net.UDPConn) {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	for _, c := range stun.sockets {
+		if c == conn {
+			return
+		}
+	}
+	stun.sockets = append(stun.sockets, conn)
+}
+
+func (stun *Stun) removeSocket(conn *net.UDPConn) {
+	stun.mutex.Lock()
+	defer stun.mutex.Unlock()
+	for i, c := range stun.sockets {
+		if c == conn {
+			stun.sockets = append(stun.sockets[:i], stun.sockets[i + 1:]...)
+			return
+		}
+	}
+}
+
+// listenUDP returns the socket served on ip and port, it listens
+// and serves a new one if there is none, which stays open so that
+// responses always go out of the same socket clients talk to
+func (stun *Stun) listenUDP(ip net.IP, port int) (*net.UDPConn, error) {
+	stun.mutex.Lock()
+	if stun.closed {
+		stun.mutex.Unlock()
+		return nil, ERROR_SERVER_CLOSED
+	}
+	if conn := stun.findSocket(ip, port); conn != nil {
+		stun.mutex.Unlock()
+		return conn, nil
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		stun.mutex.Unlock()
+		return nil, err
+	}
+	stun.sockets = append(stun.sockets, conn)
+	stun.mutex.Unlock()
+
+	go stun.RunUDP(conn)
+	return conn, nil
+}
+
+// serve handles a message or a ChannelData from conn
+func (stun *Stun) serve(conn net.Conn, data []byte) {
+	if IsChannelData(data) {
+		if stun.Turn != nil {
+			stun.Turn.ChannelDataHandler(conn, data)
+		}
+		return
+	}
+	if len(data) < STUN_HEADER_LENGTH {
+		return
+	}
+
+	ctx := &StunMsgCtx{}
+	reader := NewStunReaderFromBytes(data)
+	msg, err := DecodeStunMsg(reader, &ctx.ua)
+	if err != nil {
+		return
+	}
+	stun.requestHandler(ctx, conn, msg)
 }
 
 type StunUDP struct {
@@ -0,0 +1,121 @@
+package instun
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStun_Shutdown(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A slow method, to shut down while it is being handled
+	stun := &Stun{}
+	handling := make(chan struct{})
+	stun.HandleFunc(testMethod, STUN_CLASS_REQUEST, func(w ResponseWriter, request *Request) {
+		close(handling)
+		time.Sleep(100 * time.Millisecond)
+		w.Write(NewStunMsg(testMethod, STUN_CLASS_SUCCESS_RESP, request.Msg.Tid), nil, nil)
+	})
+	served := make(chan error, 2)
+	go func () { served <- stun.Serve(context.Background(), listener) } ()
+	go func () { served <- stun.ServeUDP(context.Background(), udp) } ()
+
+	client, err := Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	responded := make(chan error, 1)
+	go func () {
+		_, _, err := client.Request(NewStunMsg(testMethod, STUN_CLASS_REQUEST, NewTid()), nil)
+		responded <- err
+	} ()
+	<-handling
+
+	err = stun.Shutdown(context.Background())
+	assert(t, err == nil, "shutdown error!")
+	assert(t, <-responded == nil, "message being handled is not drained!")
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-served:
+			assert(t, err == ERROR_SERVER_CLOSED, "serve error!")
+		case <-time.After(time.Second):
+			t.Fatal("serve doesn't return")
+		}
+	}
+
+	// The connection is closed, and nothing is served anymore
+	select {
+	case <-client.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+	err = stun.Serve(context.Background(), listener)
+	assert(t, err == ERROR_SERVER_CLOSED, "serve after shutdown!")
+}
+
+func TestStun_ShutdownTurn(t *testing.T) {
+	stun, client := startTurn(t)
+	relayed := allocate(t, client)
+
+	// The relay sockets are closed with the server
+	assert(t, stun.Shutdown(context.Background()) == nil, "shutdown error!")
+	assert(t, released(relayed), "relay port not released!")
+	stun.Turn.mutex.Lock()
+	assert(t, len(stun.Turn.allocs) == 0, "allocation left!")
+	stun.Turn.mutex.Unlock()
+}
+
+func TestStun_ShutdownTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun := &Stun{}
+	handling := make(chan struct{})
+	stun.HandleFunc(testMethod, STUN_CLASS_REQUEST, func(w ResponseWriter, request *Request) {
+		close(handling)
+		time.Sleep(time.Second)
+	})
+	go stun.Serve(context.Background(), listener)
+
+	client, err := Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Request(NewStunMsg(testMethod, STUN_CLASS_REQUEST, NewTid()), nil)
+	<-handling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	err = stun.Shutdown(ctx)
+	assert(t, err == context.DeadlineExceeded, "shutdown doesn't give up!")
+}
+
+func TestStun_ServeContext(t *testing.T) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func () { served <- (&Stun{}).ServeUDP(ctx, udp) } ()
+
+	cancel()
+	select {
+	case err := <-served:
+		assert(t, err == context.Canceled, "serve error!")
+	case <-time.After(time.Second):
+		t.Fatal("serve doesn't return")
+	}
+}
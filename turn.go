@@ -0,0 +1,518 @@
+// turn.go
+// This file describe a TURN relay of RFC 5766 and RFC 8656
+// which allocates UDP relayed transport addresses.
+//
+package instun
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	TURN_DEFAULT_LIFETIME    = 600 * time.Second
+	TURN_MAX_LIFETIME        = 3600 * time.Second
+	TURN_PERMISSION_LIFETIME = 300 * time.Second
+	TURN_CHANNEL_LIFETIME    = 600 * time.Second
+
+	TURN_TRANSPORT_UDP = 17
+	TURN_EVEN_PORT_TRIES = 16
+)
+
+type TurnServer struct {
+	// RelayIP is the address relayed transport addresses are allocated
+	// on, if it is nil or unspecified they are allocated on the address
+	// the client reached the server on
+	RelayIP net.IP
+	// MaxLifetime bounds the LIFETIME a client can ask for
+	MaxLifetime time.Duration
+
+	mutex  sync.Mutex
+	allocs map[string]*turnAllocation
+}
+
+type turnAllocation struct {
+	turn     *TurnServer
+	key      string
+	tid      [STUN_TID_SIZE]byte // of the Allocate request
+	user     string              // who made the allocation
+	conn     net.Conn            // to the client
+	ip       net.IP // of the relayed transport address
+	relay    *net.UDPConn
+	timer    *time.Timer
+	lifetime time.Duration // granted to the Allocate request
+
+	mutex sync.Mutex
+	perms map[string]time.Time // by peer IP
+	chans map[uint16]*turnChannel
+	peers map[string]*turnChannel // by peer address
+}
+
+type turnChannel struct {
+	number uint16
+	peer   *net.UDPAddr
+	expire time.Time
+}
+
+func NewTurnServer(relayIP net.IP) *TurnServer {
+	return &TurnServer{
+		RelayIP:     normalizeIP(relayIP),
+		MaxLifetime: TURN_MAX_LIFETIME,
+		allocs:      make(map[string]*turnAllocation),
+	}
+}
+
+// fiveTuple identifies the allocation of the client on conn
+func fiveTuple(conn net.Conn) string {
+	return conn.LocalAddr().Network() + ":" + conn.LocalAddr().String() +
+		"-" + conn.RemoteAddr().String()
+}
+
+func (turn *TurnServer) allocation(conn net.Conn) *turnAllocation {
+	turn.mutex.Lock()
+	defer turn.mutex.Unlock()
+	return turn.allocs[fiveTuple(conn)]
+}
+
+// ownAllocation returns the allocation of the client of request,
+// answering it with an error if there is none or it is not
+// the authenticated user's
+func (turn *TurnServer) ownAllocation(w ResponseWriter, request *Request) *turnAllocation {
+	alloc := turn.allocation(request.Conn)
+	if alloc == nil {
+		Error(w, request, 437, "Allocation Mismatch")
+		return nil
+	}
+	if alloc.user != request.Username() {
+		Error(w, request, 441, "Wrong Credentials")
+		return nil
+	}
+	return alloc
+}
+
+// lifetime computes the lifetime msg asks for
+func (turn *TurnServer) lifetime(msg *StunMsg) time.Duration {
+	attr := msg.PeekAttr(STUN_ATTR_LIFETIME)
+	if attr == nil {
+		return TURN_DEFAULT_LIFETIME
+	}
+	lifetime := time.Duration(attr.AttrValue.(uint32)) * time.Second
+	if lifetime == 0 {
+		return 0
+	}
+	if lifetime > turn.MaxLifetime {
+		lifetime = turn.MaxLifetime
+	}
+	if lifetime < TURN_DEFAULT_LIFETIME {
+		lifetime = TURN_DEFAULT_LIFETIME
+	}
+	return lifetime
+}
+
+// ServeSTUN handles the TURN requests and Send indications. Requests
+// must be authenticated with the long-term credentials, RFC 5766
+// section 4, or the server would be an open relay.
+func (turn *TurnServer) ServeSTUN(w ResponseWriter, request *Request) {
+	msg := request.Msg
+	if msg.Class() == STUN_CLASS_REQUEST && request.Username() == "" {
+		Error(w, request, 401, "Unauthorized")
+		return
+	}
+	switch msg.Class() {
+	case STUN_CLASS_REQUEST:
+		switch msg.Method() {
+		case STUN_METHOD_ALLOCATE:
+			turn.allocate(w, request)
+		case STUN_METHOD_REFRESH:
+			turn.refresh(w, request)
+		case STUN_METHOD_CREATEPERM:
+			turn.createPermission(w, request)
+		case STUN_METHOD_CHANBIND:
+			turn.channelBind(w, request)
+		}
+	case STUN_CLASS_INDICATION:
+		if msg.Method() == STUN_METHOD_SEND {
+			turn.send(request.Conn, msg)
+		}
+	}
+}
+
+// relayIP returns the address to allocate on for the client on conn,
+// nil if none can be found
+func (turn *TurnServer) relayIP(conn net.Conn) net.IP {
+	if ip := turn.RelayIP; len(ip) > 0 && !ip.IsUnspecified() {
+		return normalizeIP(ip)
+	}
+	if ip, _ := getConnLAddress(conn); len(ip) > 0 && !ip.IsUnspecified() {
+		return ip
+	}
+
+	// A socket bound to any address: the interface routing to the client
+	rip, rport := getConnRAddress(conn)
+	route, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: rip, Port: rport})
+	if err != nil {
+		return nil
+	}
+	defer route.Close()
+	return normalizeIP(route.LocalAddr().(*net.UDPAddr).IP)
+}
+
+func (turn *TurnServer) listenRelay(ip net.IP, even bool) (*net.UDPConn, error) {
+	for i := 0; i < TURN_EVEN_PORT_TRIES; i++ {
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		if err != nil {
+			return nil, err
+		}
+		if !even || relay.LocalAddr().(*net.UDPAddr).Port & 0x1 == 0 {
+			return relay, nil
+		}
+		relay.Close()
+	}
+	return nil, ERROR_PROTO_ERROR
+}
+
+func (turn *TurnServer) allocate(w ResponseWriter, request *Request) {
+	msg, conn := request.Msg, request.Conn
+	key := fiveTuple(conn)
+	turn.mutex.Lock()
+	alloc := turn.allocs[key]
+	turn.mutex.Unlock()
+	if alloc != nil {
+		if alloc.tid == msg.Tid && alloc.user == request.Username() {
+			// Retransmission of the request
+			alloc.allocateResponse(w, request, alloc.lifetime)
+			return
+		}
+		Error(w, request, 437, "Allocation Mismatch")
+		return
+	}
+
+	rt := msg.PeekAttr(STUN_ATTR_REQ_TRANSPORT)
+	if rt == nil {
+		Error(w, request, 400, "Bad Request")
+		return
+	}
+	if rt.AttrValue.(uint8) != TURN_TRANSPORT_UDP {
+		Error(w, request, 442, "Unsupported Transport Protocol")
+		return
+	}
+	ip := turn.relayIP(conn)
+	if ip == nil {
+		Error(w, request, 508, "Insufficient Capacity")
+		return
+	}
+	if af := msg.PeekAttr(STUN_ATTR_REQ_ADDR_FAMILY); af != nil {
+		family := uint8(STUN_AF_IPV4)
+		if len(ip) == net.IPv6len {
+			family = STUN_AF_IPV6
+		}
+		if af.AttrValue.(uint8) != family {
+			Error(w, request, 440, "Address Family not Supported")
+			return
+		}
+	}
+	if msg.PeekAttr(STUN_ATTR_RSV_TOKEN) != nil {
+		// No port is ever reserved
+		Error(w, request, 508, "Insufficient Capacity")
+		return
+	}
+
+	relay, err := turn.listenRelay(ip, msg.PeekAttr(STUN_ATTR_EVEN_PORT) != nil)
+	if err != nil {
+		debug(err)
+		Error(w, request, 508, "Insufficient Capacity")
+		return
+	}
+
+	lifetime := turn.lifetime(msg)
+	if lifetime == 0 {
+		lifetime = TURN_DEFAULT_LIFETIME
+	}
+	alloc = &turnAllocation{
+		turn:     turn,
+		key:      key,
+		tid:      msg.Tid,
+		user:     request.Username(),
+		conn:     conn,
+		ip:       ip,
+		relay:    relay,
+		lifetime: lifetime,
+		perms:    make(map[string]time.Time),
+		chans:    make(map[uint16]*turnChannel),
+		peers:    make(map[string]*turnChannel),
+	}
+	alloc.timer = time.AfterFunc(lifetime, alloc.delete)
+
+	turn.mutex.Lock()
+	turn.allocs[key] = alloc
+	turn.mutex.Unlock()
+	debug("turn: allocate", relay.LocalAddr(), "for", conn.RemoteAddr())
+
+	go alloc.relayLoop()
+	alloc.allocateResponse(w, request, lifetime)
+}
+
+func (alloc *turnAllocation) allocateResponse(w ResponseWriter, request *Request,
+	lifetime time.Duration) {
+	msg := request.Msg
+	tid := msg.Tid[:]
+	relayed := NewStunAddr(normalizeIP(alloc.ip),
+		alloc.relay.LocalAddr().(*net.UDPAddr).Port).Xor(tid)
+	mapped := NewStunAddr(getConnRAddress(alloc.conn)).Xor(tid)
+	if relayed == nil || mapped == nil {
+		Error(w, request, 500, "Server Error")
+		return
+	}
+	rmsg := NewStunMsg(STUN_METHOD_ALLOCATE, STUN_CLASS_SUCCESS_RESP, msg.Tid)
+	rmsg.AddAttr(NewStunAttr(STUN_ATTR_XOR_RELAY_ADDR, relayed))
+	rmsg.AddAttr(NewStunAttr(STUN_ATTR_LIFETIME, uint32(lifetime / time.Second)))
+	rmsg.AddAttr(NewStunAttr(STUN_ATTR_XOR_MAPPED_ADDR, mapped))
+	w.Write(rmsg, nil, nil)
+}
+
+func (turn *TurnServer) refresh(w ResponseWriter, request *Request) {
+	msg := request.Msg
+	alloc := turn.ownAllocation(w, request)
+	if alloc == nil {
+		return
+	}
+
+	lifetime := turn.lifetime(msg)
+	if lifetime == 0 {
+		alloc.delete()
+	} else {
+		alloc.timer.Reset(lifetime)
+	}
+
+	rmsg := NewStunMsg(STUN_METHOD_REFRESH, STUN_CLASS_SUCCESS_RESP, msg.Tid)
+	rmsg.AddAttr(NewStunAttr(STUN_ATTR_LIFETIME, uint32(lifetime / time.Second)))
+	w.Write(rmsg, nil, nil)
+}
+
+// peerAddress returns XOR-PEER-ADDRESS attributes of msg,
+// nil if any of them is not of the relay address family
+func (alloc *turnAllocation) peerAddress(msg *StunMsg) ([]*net.UDPAddr, bool) {
+	var peers []*net.UDPAddr
+	for _, attr := range msg.Attr {
+		if attr.AttrType != STUN_ATTR_XOR_PEER_ADDR {
+			continue
+		}
+		addr := attr.AttrValue.(*StunAddr)
+		if len(addr.IP) != len(alloc.ip) {
+			return nil, false
+		}
+		peers = append(peers, &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	}
+	return peers, true
+}
+
+func (turn *TurnServer) createPermission(w ResponseWriter, request *Request) {
+	msg := request.Msg
+	alloc := turn.ownAllocation(w, request)
+	if alloc == nil {
+		return
+	}
+
+	peers, ok := alloc.peerAddress(msg)
+	if !ok {
+		Error(w, request, 443, "Peer Address Family Mismatch")
+		return
+	}
+	if len(peers) == 0 {
+		Error(w, request, 400, "Bad Request")
+		return
+	}
+
+	expire := time.Now().Add(TURN_PERMISSION_LIFETIME)
+	alloc.mutex.Lock()
+	for _, peer := range peers {
+		alloc.perms[peer.IP.String()] = expire
+	}
+	alloc.mutex.Unlock()
+
+	rmsg := NewStunMsg(STUN_METHOD_CREATEPERM, STUN_CLASS_SUCCESS_RESP, msg.Tid)
+	w.Write(rmsg, nil, nil)
+}
+
+func (turn *TurnServer) channelBind(w ResponseWriter, request *Request) {
+	msg := request.Msg
+	alloc := turn.ownAllocation(w, request)
+	if alloc == nil {
+		return
+	}
+
+	cn := msg.PeekAttr(STUN_ATTR_CHANNEL_NUMBER)
+	if cn == nil {
+		Error(w, request, 400, "Bad Request")
+		return
+	}
+	number := cn.AttrValue.(uint16)
+	if number < CHANNEL_MIN || number > CHANNEL_MAX {
+		Error(w, request, 400, "Bad Request")
+		return
+	}
+	peers, ok := alloc.peerAddress(msg)
+	if !ok {
+		Error(w, request, 443, "Peer Address Family Mismatch")
+		return
+	}
+	if len(peers) != 1 {
+		Error(w, request, 400, "Bad Request")
+		return
+	}
+	peer := peers[0]
+
+	now := time.Now()
+	alloc.mutex.Lock()
+	ch := alloc.chans[number]
+	if ch != nil && ch.expire.After(now) && ch.peer.String() != peer.String() {
+		alloc.mutex.Unlock()
+		Error(w, request, 400, "Bad Request")
+		return
+	}
+	if old := alloc.peers[peer.String()]; old != nil &&
+		old.expire.After(now) && old.number != number {
+		alloc.mutex.Unlock()
+		Error(w, request, 400, "Bad Request")
+		return
+	}
+	if ch == nil || ch.peer.String() != peer.String() {
+		if ch != nil {
+			delete(alloc.peers, ch.peer.String())
+		}
+		ch = &turnChannel{
+			number: number,
+			peer:   peer,
+		}
+		alloc.chans[number] = ch
+		alloc.peers[peer.String()] = ch
+	}
+	ch.expire = now.Add(TURN_CHANNEL_LIFETIME)
+	alloc.perms[peer.IP.String()] = now.Add(TURN_PERMISSION_LIFETIME)
+	alloc.mutex.Unlock()
+
+	rmsg := NewStunMsg(STUN_METHOD_CHANBIND, STUN_CLASS_SUCCESS_RESP, msg.Tid)
+	w.Write(rmsg, nil, nil)
+}
+
+// send relays the DATA of a Send indication to its peer
+func (turn *TurnServer) send(conn net.Conn, msg *StunMsg) bool {
+	alloc := turn.allocation(conn)
+	if alloc == nil {
+		return false
+	}
+
+	data := msg.PeekAttr(STUN_ATTR_DATA)
+	peers, ok := alloc.peerAddress(msg)
+	if data == nil || !ok || len(peers) != 1 {
+		return false
+	}
+	if !alloc.permitted(peers[0].IP) {
+		return false
+	}
+	if _, err := alloc.relay.WriteToUDP(data.AttrValue.([]byte), peers[0]); err != nil {
+		debug(err)
+		return false
+	}
+	return true
+}
+
+// ChannelDataHandler relays a ChannelData message from conn to the
+// peer bound to its channel
+func (turn *TurnServer) ChannelDataHandler(conn net.Conn, b []byte) bool {
+	number, data, err := DecodeChannelData(b)
+	if err != nil {
+		return false
+	}
+	alloc := turn.allocation(conn)
+	if alloc == nil {
+		return false
+	}
+
+	alloc.mutex.Lock()
+	ch := alloc.chans[number]
+	alloc.mutex.Unlock()
+	if ch == nil || ch.expire.Before(time.Now()) {
+		return false
+	}
+	if _, err := alloc.relay.WriteToUDP(data, ch.peer); err != nil {
+		debug(err)
+		return false
+	}
+	return true
+}
+
+func (alloc *turnAllocation) permitted(ip net.IP) bool {
+	alloc.mutex.Lock()
+	defer alloc.mutex.Unlock()
+	expire, ok := alloc.perms[normalizeIP(ip).String()]
+	return ok && expire.After(time.Now())
+}
+
+// relayLoop sends the data peers send to the relayed
+// transport address back to the client
+func (alloc *turnAllocation) relayLoop() {
+	_, stream := alloc.conn.LocalAddr().(*net.TCPAddr)
+	buff := make([]byte, MAX_PACKET_SIZE)
+	for {
+		n, peer, err := alloc.relay.ReadFromUDP(buff)
+		if err != nil {
+			return
+		}
+		if !alloc.permitted(peer.IP) {
+			continue
+		}
+
+		alloc.mutex.Lock()
+		ch := alloc.peers[peer.String()]
+		alloc.mutex.Unlock()
+		if ch != nil && ch.expire.After(time.Now()) {
+			alloc.conn.Write(EncodeChannelData(ch.number, buff[:n], stream))
+			continue
+		}
+
+		msg := NewStunMsg(STUN_METHOD_DATA, STUN_CLASS_INDICATION, NewTid())
+		msg.AddAttr(NewStunAttr(STUN_ATTR_XOR_PEER_ADDR,
+			NewStunAddr(normalizeIP(peer.IP), peer.Port).Xor(msg.Tid[:])))
+		msg.AddAttr(NewStunAttr(STUN_ATTR_DATA, buff[:n]))
+		if data, err := msg.Encode(nil, nil, false, PADDING_BYTE); err == nil {
+			alloc.conn.Write(data)
+		}
+	}
+}
+
+// closeConn deletes the allocation of the client on conn, when the
+// TCP or TLS connection the allocation is made over is closed
+func (turn *TurnServer) closeConn(conn net.Conn) {
+	if alloc := turn.allocation(conn); alloc != nil {
+		alloc.delete()
+	}
+}
+
+// close deletes all the allocations, when the server is shut down
+func (turn *TurnServer) close() {
+	turn.mutex.Lock()
+	allocs := make([]*turnAllocation, 0, len(turn.allocs))
+	for _, alloc := range turn.allocs {
+		allocs = append(allocs, alloc)
+	}
+	turn.mutex.Unlock()
+
+	for _, alloc := range allocs {
+		alloc.delete()
+	}
+}
+
+func (alloc *turnAllocation) delete() {
+	turn := alloc.turn
+	turn.mutex.Lock()
+	if turn.allocs[alloc.key] == alloc {
+		delete(turn.allocs, alloc.key)
+	}
+	turn.mutex.Unlock()
+
+	alloc.timer.Stop()
+	alloc.relay.Close()
+	debug("turn: delete", alloc.relay.LocalAddr())
+}
@@ -0,0 +1,384 @@
+package instun
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+var loopback = net.IPv4(127, 0, 0, 1)
+
+// turnCredentials authenticates "user" with "pass" in "realm"
+func turnCredentials() *LongTermAuth {
+	return NewLongTermAuth("realm", func(username string) (string, bool) {
+		return "pass", username == "user"
+	})
+}
+
+// turnClient signs its requests with the credentials of
+// turnCredentials, with the nonce the server challenged with
+type turnClient struct {
+	*Client
+	nonce string
+}
+
+// startTurn serves an authenticated TURN relay on a loopback
+// UDP socket, and returns it with a client talking to it
+func startTurn(t *testing.T) (*Stun, *turnClient) {
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun := &Stun{Turn: NewTurnServer(loopback), LongTerm: turnCredentials()}
+	go stun.RunUDP(udp)
+	t.Cleanup(func() { stun.Shutdown(context.Background()) })
+
+	client, err := Dial("udp4", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.RTO = 100 * time.Millisecond
+	t.Cleanup(func() { client.Close() })
+	return stun, &turnClient{Client: client}
+}
+
+// turnRequest runs a TURN transaction, XOR addresses in attrs are
+// given plain. A challenge is answered once with the new nonce.
+func turnRequest(t *testing.T, client *turnClient, method uint16, tid [STUN_TID_SIZE]byte,
+	attrs ...*StunAttr) *StunMsg {
+	for retry := true; ; retry = false {
+		msg := NewStunMsg(method, STUN_CLASS_REQUEST, tid)
+		for _, attr := range attrs {
+			msg.AddAttr(xorAttr(attr, tid))
+		}
+		var key []byte
+		if client.nonce != "" {
+			msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, "user"))
+			msg.AddAttr(NewStunAttr(STUN_ATTR_REALM, "realm"))
+			msg.AddAttr(NewStunAttr(STUN_ATTR_NONCE, client.nonce))
+			key = LongTermKey("user", "realm", "pass")
+		}
+		rmsg, _, err := client.transaction(msg, key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := responseCode(rmsg)
+		nonce := rmsg.PeekAttr(STUN_ATTR_NONCE)
+		if retry && (code == 401 || code == 438) && nonce != nil {
+			client.nonce = nonce.AttrValue.(string)
+			continue
+		}
+		return rmsg
+	}
+}
+
+// responseCode returns the ERROR-CODE of rmsg, 0 for a success response
+func responseCode(rmsg *StunMsg) uint16 {
+	if ec := rmsg.PeekAttr(STUN_ATTR_ERR_CODE); ec != nil {
+		return ec.AttrValue.(*ErrorCode).Code
+	}
+	return 0
+}
+
+func udpTransport() *StunAttr {
+	return NewStunAttr(STUN_ATTR_REQ_TRANSPORT, uint8(TURN_TRANSPORT_UDP))
+}
+
+func peerAttr(peer net.Addr) *StunAttr {
+	addr := peer.(*net.UDPAddr)
+	return NewStunAttr(STUN_ATTR_XOR_PEER_ADDR, NewStunAddr(normalizeIP(addr.IP), addr.Port))
+}
+
+// allocate makes an allocation for client, and returns the relayed address
+func allocate(t *testing.T, client *turnClient) *net.UDPAddr {
+	rmsg := turnRequest(t, client, STUN_METHOD_ALLOCATE, NewTid(), udpTransport())
+	if code := responseCode(rmsg); code != 0 {
+		t.Fatalf("allocate: %d", code)
+	}
+	relayed := rmsg.PeekAttr(STUN_ATTR_XOR_RELAY_ADDR).AttrValue.(*StunAddr)
+	return &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}
+}
+
+// listenPeer returns a peer socket on loopback
+func listenPeer(t *testing.T) *net.UDPConn {
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return peer
+}
+
+func readPeer(t *testing.T, peer *net.UDPConn) ([]byte, *net.UDPAddr) {
+	buff := make([]byte, MAX_PACKET_SIZE)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFromUDP(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buff[:n], from
+}
+
+// received collects what the server sends to client besides responses
+func received(client *turnClient) chan []byte {
+	ch := make(chan []byte, 16)
+	client.SetHandler(func(data []byte, from net.Addr) {
+		ch <- append([]byte{}, data...)
+	})
+	return ch
+}
+
+func receive(t *testing.T, ch chan []byte) []byte {
+	select {
+	case data := <-ch:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("nothing relayed")
+	}
+	return nil
+}
+
+// released reports whether the relayed port can be bound again
+func released(relayed *net.UDPAddr) bool {
+	for i := 0; i < 50; i++ {
+		if conn, err := net.ListenUDP("udp4", relayed); err == nil {
+			conn.Close()
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTurnServer_Allocate(t *testing.T) {
+	stun, client := startTurn(t)
+
+	// LIFETIME 0 gets the default lifetime, and so does the retransmission
+	tid := NewTid()
+	lifetime := NewStunAttr(STUN_ATTR_LIFETIME, uint32(0))
+	rmsg := turnRequest(t, client, STUN_METHOD_ALLOCATE, tid, udpTransport(), lifetime)
+	assert(t, responseCode(rmsg) == 0, "allocate error!")
+	relayed := rmsg.PeekAttr(STUN_ATTR_XOR_RELAY_ADDR).AttrValue.(*StunAddr)
+	assert(t, relayed.IP.Equal(loopback) && relayed.Port != 0, "relayed address error!")
+	assert(t, responseLifetime(rmsg) == TURN_DEFAULT_LIFETIME, "lifetime error!")
+	mapped := rmsg.PeekAttr(STUN_ATTR_XOR_MAPPED_ADDR).AttrValue.(*StunAddr)
+	assert(t, mapped.Port == client.LocalAddr().(*net.UDPAddr).Port, "mapped address error!")
+
+	rmsg = turnRequest(t, client, STUN_METHOD_ALLOCATE, tid, udpTransport(), lifetime)
+	assert(t, responseCode(rmsg) == 0, "retransmission error!")
+	again := rmsg.PeekAttr(STUN_ATTR_XOR_RELAY_ADDR).AttrValue.(*StunAddr)
+	assert(t, again.Equal(relayed), "retransmission allocates again!")
+	assert(t, responseLifetime(rmsg) == TURN_DEFAULT_LIFETIME, "retransmission lifetime error!")
+
+	// Another Allocate on the same 5-tuple
+	rmsg = turnRequest(t, client, STUN_METHOD_ALLOCATE, NewTid(), udpTransport())
+	assert(t, responseCode(rmsg) == 437, "allocation mismatch error!")
+
+	stun.Turn.mutex.Lock()
+	assert(t, len(stun.Turn.allocs) == 1, "allocation count error!")
+	stun.Turn.mutex.Unlock()
+}
+
+func TestTurnServer_AllocateErrors(t *testing.T) {
+	_, client := startTurn(t)
+
+	rmsg := turnRequest(t, client, STUN_METHOD_ALLOCATE, NewTid())
+	assert(t, responseCode(rmsg) == 400, "allocate without REQUESTED-TRANSPORT!")
+	rmsg = turnRequest(t, client, STUN_METHOD_ALLOCATE, NewTid(),
+		NewStunAttr(STUN_ATTR_REQ_TRANSPORT, uint8(6)))
+	assert(t, responseCode(rmsg) == 442, "allocate over TCP!")
+	rmsg = turnRequest(t, client, STUN_METHOD_ALLOCATE, NewTid(), udpTransport(),
+		NewStunAttr(STUN_ATTR_REQ_ADDR_FAMILY, uint8(STUN_AF_IPV6)))
+	assert(t, responseCode(rmsg) == 440, "allocate of another family!")
+
+	// Nothing to refresh or to permit without an allocation
+	rmsg = turnRequest(t, client, STUN_METHOD_REFRESH, NewTid())
+	assert(t, responseCode(rmsg) == 437, "refresh without allocation!")
+	rmsg = turnRequest(t, client, STUN_METHOD_CREATEPERM, NewTid(),
+		peerAttr(client.LocalAddr()))
+	assert(t, responseCode(rmsg) == 437, "permission without allocation!")
+}
+
+func TestTurnServer_Refresh(t *testing.T) {
+	stun, client := startTurn(t)
+	relayed := allocate(t, client)
+
+	rmsg := turnRequest(t, client, STUN_METHOD_REFRESH, NewTid(),
+		NewStunAttr(STUN_ATTR_LIFETIME, uint32(1200)))
+	assert(t, responseCode(rmsg) == 0, "refresh error!")
+	assert(t, responseLifetime(rmsg) == 1200 * time.Second, "refresh lifetime error!")
+
+	// LIFETIME 0 deletes the allocation
+	rmsg = turnRequest(t, client, STUN_METHOD_REFRESH, NewTid(),
+		NewStunAttr(STUN_ATTR_LIFETIME, uint32(0)))
+	assert(t, responseCode(rmsg) == 0, "delete error!")
+	assert(t, responseLifetime(rmsg) == 0, "delete lifetime error!")
+	assert(t, released(relayed), "relayed address not released!")
+	stun.Turn.mutex.Lock()
+	assert(t, len(stun.Turn.allocs) == 0, "allocation not deleted!")
+	stun.Turn.mutex.Unlock()
+
+	rmsg = turnRequest(t, client, STUN_METHOD_REFRESH, NewTid())
+	assert(t, responseCode(rmsg) == 437, "refresh of a deleted allocation!")
+}
+
+func TestTurnServer_Permission(t *testing.T) {
+	_, client := startTurn(t)
+	relayed := allocate(t, client)
+	data := received(client)
+	peer := listenPeer(t)
+
+	// Dropped without a permission
+	peer.WriteToUDP([]byte("dropped"), relayed)
+	rmsg := turnRequest(t, client, STUN_METHOD_CREATEPERM, NewTid())
+	assert(t, responseCode(rmsg) == 400, "permission without peer!")
+	rmsg = turnRequest(t, client, STUN_METHOD_CREATEPERM, NewTid(), peerAttr(peer.LocalAddr()))
+	assert(t, responseCode(rmsg) == 0, "permission error!")
+
+	// Data indication to the client
+	peer.WriteToUDP([]byte("hello"), relayed)
+	msg, err := DecodeStunMsg(NewStunReaderFromBytes(receive(t, data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, msg.Method() == STUN_METHOD_DATA && msg.Class() == STUN_CLASS_INDICATION,
+		"data indication error!")
+	assert(t, bytes.Equal(msg.PeekAttr(STUN_ATTR_DATA).AttrValue.([]byte), []byte("hello")),
+		"relayed data error!")
+	from := msg.PeekAttr(STUN_ATTR_XOR_PEER_ADDR).AttrValue.(*StunAddr)
+	assert(t, from.Port == peer.LocalAddr().(*net.UDPAddr).Port, "peer address error!")
+
+	// Send indication to the peer
+	send := NewStunMsg(STUN_METHOD_SEND, STUN_CLASS_INDICATION, NewTid())
+	send.AddAttr(xorAttr(peerAttr(peer.LocalAddr()), send.Tid))
+	send.AddAttr(NewStunAttr(STUN_ATTR_DATA, []byte("world")))
+	b, _ := send.Encode(nil, nil, false, PADDING_BYTE)
+	client.write(b, nil)
+	payload, source := readPeer(t, peer)
+	assert(t, string(payload) == "world", "sent data error!")
+	assert(t, source.Port == relayed.Port, "data not sent from the relayed address!")
+}
+
+func TestTurnServer_ChannelBind(t *testing.T) {
+	_, client := startTurn(t)
+	relayed := allocate(t, client)
+	data := received(client)
+	peer := listenPeer(t)
+	number := NewStunAttr(STUN_ATTR_CHANNEL_NUMBER, uint16(CHANNEL_MIN))
+
+	rmsg := turnRequest(t, client, STUN_METHOD_CHANBIND, NewTid(),
+		NewStunAttr(STUN_ATTR_CHANNEL_NUMBER, uint16(0x3fff)), peerAttr(peer.LocalAddr()))
+	assert(t, responseCode(rmsg) == 400, "channel number out of range!")
+	rmsg = turnRequest(t, client, STUN_METHOD_CHANBIND, NewTid(), number)
+	assert(t, responseCode(rmsg) == 400, "channel without peer!")
+	rmsg = turnRequest(t, client, STUN_METHOD_CHANBIND, NewTid(), number, peerAttr(peer.LocalAddr()))
+	assert(t, responseCode(rmsg) == 0, "channel bind error!")
+
+	// The channel is bound to one peer, and the peer to one channel
+	other := listenPeer(t)
+	rmsg = turnRequest(t, client, STUN_METHOD_CHANBIND, NewTid(), number, peerAttr(other.LocalAddr()))
+	assert(t, responseCode(rmsg) == 400, "channel bound twice!")
+	rmsg = turnRequest(t, client, STUN_METHOD_CHANBIND, NewTid(),
+		NewStunAttr(STUN_ATTR_CHANNEL_NUMBER, uint16(CHANNEL_MIN + 1)), peerAttr(peer.LocalAddr()))
+	assert(t, responseCode(rmsg) == 400, "peer bound twice!")
+
+	// ChannelData both ways, the binding installs the permission
+	peer.WriteToUDP([]byte("hello"), relayed)
+	channel, payload, err := DecodeChannelData(receive(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, channel == CHANNEL_MIN && string(payload) == "hello", "channel data error!")
+
+	client.write(EncodeChannelData(CHANNEL_MIN, []byte("world"), false), nil)
+	payload, source := readPeer(t, peer)
+	assert(t, string(payload) == "world", "relayed channel data error!")
+	assert(t, source.Port == relayed.Port, "channel data not sent from the relayed address!")
+}
+
+func TestTurnServer_CloseStream(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun := &Stun{Turn: NewTurnServer(loopback), LongTerm: turnCredentials()}
+	go stun.Run(listener)
+	defer stun.Shutdown(context.Background())
+
+	client, err := Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed := allocate(t, &turnClient{Client: client})
+
+	// The allocation goes with the connection
+	client.Close()
+	assert(t, released(relayed), "relayed address not released!")
+	stun.Turn.mutex.Lock()
+	assert(t, len(stun.Turn.allocs) == 0, "allocation not deleted!")
+	stun.Turn.mutex.Unlock()
+}
+
+func TestTurnServer_Unauthenticated(t *testing.T) {
+	// Without long-term credentials the relay is refused
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun := &Stun{Turn: NewTurnServer(loopback)}
+	go stun.RunUDP(udp)
+	defer stun.Shutdown(context.Background())
+
+	client, err := Dial("udp4", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rmsg := turnRequest(t, &turnClient{Client: client}, STUN_METHOD_ALLOCATE, NewTid(), udpTransport())
+	assert(t, responseCode(rmsg) == 401, "open relay!")
+	stun.Turn.mutex.Lock()
+	assert(t, len(stun.Turn.allocs) == 0, "unauthenticated allocation!")
+	stun.Turn.mutex.Unlock()
+}
+
+func TestTurnServer_NotSet(t *testing.T) {
+	// Without stun.Turn an Allocate is refused, not dropped
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun := &Stun{}
+	go stun.RunUDP(udp)
+	defer stun.Shutdown(context.Background())
+
+	client, err := Dial("udp4", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	rmsg := turnRequest(t, &turnClient{Client: client}, STUN_METHOD_ALLOCATE, NewTid(), udpTransport())
+	assert(t, responseCode(rmsg) == 400, "allocate without turn server is not refused!")
+}
+
+func TestTurnServer_UnspecifiedRelayIP(t *testing.T) {
+	for _, ip := range []net.IP{nil, net.IPv4zero} {
+		udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stun := &Stun{Turn: NewTurnServer(ip), LongTerm: turnCredentials()}
+		go stun.RunUDP(udp)
+		defer stun.Shutdown(context.Background())
+
+		// Relayed on the address the client reached the server on
+		client, err := Dial("udp4", udp.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		relayed := allocate(t, &turnClient{Client: client})
+		assert(t, relayed.IP.Equal(loopback) && relayed.Port != 0, "relayed address error!")
+	}
+}
@@ -0,0 +1,494 @@
+// turnclient.go
+// This file describe a TURN client which hands back the relayed
+// transport address as a net.PacketConn.
+//
+package instun
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ERROR_NO_RELAYED_ADDRESS = errors.New("InStun: no relayed address in response")
+	ERROR_CHANNEL_EXHAUSTED = errors.New("InStun: no channel number left")
+)
+
+const (
+	// Refresh what expires within TURN_REFRESH_MARGIN
+	TURN_REFRESH_MARGIN = time.Minute
+	TURN_REFRESH_INTERVAL = 15 * time.Second
+	TURN_QUEUE_SIZE = 128
+)
+
+// TurnConn is a net.PacketConn whose packets go through the relayed
+// transport address of a TURN allocation
+type TurnConn struct {
+	client   *Client
+	username string
+	password string
+
+	mutex    sync.Mutex
+	realm    string
+	nonce    string
+	key      []byte
+	relayed  *StunAddr
+	mapped   *StunAddr
+	expire   time.Time
+	perms    map[string]time.Time // by peer IP
+	chans    map[string]*turnChannel // by peer address
+	numbers  map[uint16]*turnChannel
+	next     uint16
+	deadline time.Time
+	changed  chan struct{} // closed when deadline is changed
+
+	queue  chan *turnPacket
+	closed chan struct{}
+}
+
+type turnPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// DialTurn connects to the TURN server at address and allocates
+// a relayed transport address, network is like Dial's
+func DialTurn(network, address, username, password string) (*TurnConn, error) {
+	client, err := Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := Allocate(client, username, password)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Allocate asks the server of client for a relayed transport address,
+// authenticating with the long-term credentials if challenged. The
+// returned TurnConn takes the client over and closes it on Close.
+func Allocate(client *Client, username, password string) (*TurnConn, error) {
+	conn := &TurnConn{
+		client:   client,
+		username: username,
+		password: password,
+		perms:    make(map[string]time.Time),
+		chans:    make(map[string]*turnChannel),
+		numbers:  make(map[uint16]*turnChannel),
+		next:     CHANNEL_MIN,
+		changed:  make(chan struct{}),
+		queue:    make(chan *turnPacket, TURN_QUEUE_SIZE),
+		closed:   make(chan struct{}),
+	}
+	client.SetHandler(conn.handle)
+
+	rmsg, err := conn.request(STUN_METHOD_ALLOCATE,
+		NewStunAttr(STUN_ATTR_REQ_TRANSPORT, uint8(TURN_TRANSPORT_UDP)))
+	if err != nil {
+		return nil, err
+	}
+
+	relayed := rmsg.PeekAttr(STUN_ATTR_XOR_RELAY_ADDR)
+	if relayed == nil {
+		return nil, ERROR_NO_RELAYED_ADDRESS
+	}
+	conn.relayed = relayed.AttrValue.(*StunAddr)
+	if mapped := rmsg.PeekAttr(STUN_ATTR_XOR_MAPPED_ADDR); mapped != nil {
+		conn.mapped = mapped.AttrValue.(*StunAddr)
+	}
+	conn.expire = time.Now().Add(responseLifetime(rmsg))
+
+	go conn.refreshLoop()
+	return conn, nil
+}
+
+func responseLifetime(msg *StunMsg) time.Duration {
+	if attr := msg.PeekAttr(STUN_ATTR_LIFETIME); attr != nil {
+		return time.Duration(attr.AttrValue.(uint32)) * time.Second
+	}
+	return TURN_DEFAULT_LIFETIME
+}
+
+// xorAttr returns attr xored with tid if it holds a XOR address
+func xorAttr(attr *StunAttr, tid [STUN_TID_SIZE]byte) *StunAttr {
+	switch attr.AttrType {
+	case STUN_ATTR_XOR_PEER_ADDR: fallthrough
+	case STUN_ATTR_XOR_RELAY_ADDR: fallthrough
+	case STUN_ATTR_XOR_MAPPED_ADDR:
+		addr := attr.AttrValue.(*StunAddr)
+		return NewStunAttr(attr.AttrType,
+			NewStunAddr(normalizeIP(addr.IP), addr.Port).Xor(tid[:]))
+	}
+	return attr
+}
+
+// message makes a request of method with the credentials, if the
+// server asked for them, and returns it with the key to sign it.
+// XOR addresses in attrs are given plain, they are xored with the
+// new transaction id.
+func (conn *TurnConn) message(method uint16, attrs ...*StunAttr) (*StunMsg, []byte) {
+	msg := NewStunMsg(method, STUN_CLASS_REQUEST, NewTid())
+	for _, attr := range attrs {
+		msg.AddAttr(xorAttr(attr, msg.Tid))
+	}
+	msg.AddAttr(NewStunAttr(STUN_ATTR_SOFTWARE, SOFTWARE))
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.key != nil {
+		msg.AddAttr(NewStunAttr(STUN_ATTR_USERNAME, conn.username))
+		msg.AddAttr(NewStunAttr(STUN_ATTR_REALM, conn.realm))
+		msg.AddAttr(NewStunAttr(STUN_ATTR_NONCE, conn.nonce))
+	}
+	return msg, conn.key
+}
+
+// request runs a transaction of method, answering a 401 challenge
+// or a 438 stale nonce once, with a new message since every retry
+// is a new transaction
+func (conn *TurnConn) request(method uint16, attrs ...*StunAttr) (*StunMsg, error) {
+	for retry := 0; ; retry++ {
+		msg, key := conn.message(method, attrs...)
+		rmsg, _, err := conn.client.transaction(msg, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		if rmsg.Class() != STUN_CLASS_ERROR_RESP {
+			return rmsg, nil
+		}
+
+		ec := rmsg.PeekAttr(STUN_ATTR_ERR_CODE)
+		if ec == nil {
+			return nil, ERROR_BAD_MESSAGE
+		}
+		code := ec.AttrValue.(*ErrorCode)
+		realm := rmsg.PeekAttr(STUN_ATTR_REALM)
+		nonce := rmsg.PeekAttr(STUN_ATTR_NONCE)
+		if retry > 0 || (code.Code != 401 && code.Code != 438) ||
+			realm == nil || nonce == nil {
+			return nil, code
+		}
+		if code.Code == 401 && key != nil {
+			// Credentials were refused
+			return nil, code
+		}
+
+		conn.mutex.Lock()
+		conn.realm = realm.AttrValue.(string)
+		conn.nonce = nonce.AttrValue.(string)
+		conn.key = LongTermKey(conn.username, conn.realm, conn.password)
+		conn.mutex.Unlock()
+	}
+}
+
+// handle receives Data indications and ChannelData from the server
+func (conn *TurnConn) handle(data []byte, from net.Addr) {
+	if from.String() != conn.client.Server().String() {
+		return
+	}
+
+	packet := &turnPacket{}
+	if IsChannelData(data) {
+		number, payload, err := DecodeChannelData(data)
+		if err != nil {
+			return
+		}
+		conn.mutex.Lock()
+		ch := conn.numbers[number]
+		conn.mutex.Unlock()
+		if ch == nil {
+			return
+		}
+		packet.data = payload
+		packet.from = ch.peer
+	} else {
+		msg, err := DecodeStunMsg(NewStunReaderFromBytes(data), nil)
+		if err != nil || msg.Method() != STUN_METHOD_DATA ||
+			msg.Class() != STUN_CLASS_INDICATION {
+			return
+		}
+		peer := msg.PeekAttr(STUN_ATTR_XOR_PEER_ADDR)
+		payload := msg.PeekAttr(STUN_ATTR_DATA)
+		if peer == nil || payload == nil {
+			return
+		}
+		addr := peer.AttrValue.(*StunAddr)
+		packet.data = payload.AttrValue.([]byte)
+		packet.from = &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	}
+
+	select {
+	case conn.queue <- packet:
+	default:
+		// Drop it like the network would do
+	}
+}
+
+// ReadFrom waits for a packet until the read deadline, which
+// may be changed while it waits
+func (conn *TurnConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn.mutex.Lock()
+		deadline, changed := conn.deadline, conn.changed
+		conn.mutex.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case packet := <-conn.queue:
+			stopTimer(timer)
+			return copy(p, packet.data), packet.from, nil
+		case <-conn.closed:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func resolvePeer(addr net.Addr) (*net.UDPAddr, error) {
+	if peer, ok := addr.(*net.UDPAddr); ok {
+		return peer, nil
+	}
+	return net.ResolveUDPAddr("udp", addr.String())
+}
+
+// WriteTo sends p to addr through the relay, over the channel bound to
+// addr if any, in a Send indication otherwise. The permission for addr
+// is installed on the first write.
+func (conn *TurnConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	peer, err := resolvePeer(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	conn.mutex.Lock()
+	ch := conn.chans[peer.String()]
+	_, permitted := conn.perms[peer.IP.String()]
+	conn.mutex.Unlock()
+
+	if ch != nil {
+		data := EncodeChannelData(ch.number, p, conn.client.stream != nil)
+		if err := conn.client.write(data, nil); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	if !permitted {
+		if err := conn.CreatePermission(peer); err != nil {
+			return 0, err
+		}
+	}
+	msg := NewStunMsg(STUN_METHOD_SEND, STUN_CLASS_INDICATION, NewTid())
+	msg.AddAttr(NewStunAttr(STUN_ATTR_XOR_PEER_ADDR,
+		NewStunAddr(normalizeIP(peer.IP), peer.Port).Xor(msg.Tid[:])))
+	msg.AddAttr(NewStunAttr(STUN_ATTR_DATA, p))
+	data, err := msg.Encode(nil, nil, false, PADDING_BYTE)
+	if err != nil {
+		return 0, err
+	}
+	if err := conn.client.write(data, nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CreatePermission installs or refreshes permissions for the peers
+func (conn *TurnConn) CreatePermission(peers ...*net.UDPAddr) error {
+	var attrs []*StunAttr
+	for _, peer := range peers {
+		attrs = append(attrs, NewStunAttr(STUN_ATTR_XOR_PEER_ADDR,
+			NewStunAddr(normalizeIP(peer.IP), peer.Port)))
+	}
+	if _, err := conn.request(STUN_METHOD_CREATEPERM, attrs...); err != nil {
+		return err
+	}
+
+	expire := time.Now().Add(TURN_PERMISSION_LIFETIME)
+	conn.mutex.Lock()
+	for _, peer := range peers {
+		conn.perms[peer.IP.String()] = expire
+	}
+	conn.mutex.Unlock()
+	return nil
+}
+
+// BindChannel binds a channel to addr, so that the data exchanged
+// with addr is framed in ChannelData instead of indications
+func (conn *TurnConn) BindChannel(addr net.Addr) (uint16, error) {
+	peer, err := resolvePeer(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	conn.mutex.Lock()
+	ch := conn.chans[peer.String()]
+	if ch == nil {
+		if conn.next > CHANNEL_MAX {
+			conn.mutex.Unlock()
+			return 0, ERROR_CHANNEL_EXHAUSTED
+		}
+		ch = &turnChannel{number: conn.next, peer: peer}
+		conn.next++
+	}
+	conn.mutex.Unlock()
+
+	if err := conn.channelBind(ch); err != nil {
+		return 0, err
+	}
+	return ch.number, nil
+}
+
+func (conn *TurnConn) channelBind(ch *turnChannel) error {
+	_, err := conn.request(STUN_METHOD_CHANBIND,
+		NewStunAttr(STUN_ATTR_CHANNEL_NUMBER, ch.number),
+		NewStunAttr(STUN_ATTR_XOR_PEER_ADDR,
+			NewStunAddr(normalizeIP(ch.peer.IP), ch.peer.Port)))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	conn.mutex.Lock()
+	ch.expire = now.Add(TURN_CHANNEL_LIFETIME)
+	conn.chans[ch.peer.String()] = ch
+	conn.numbers[ch.number] = ch
+	conn.perms[ch.peer.IP.String()] = now.Add(TURN_PERMISSION_LIFETIME)
+	conn.mutex.Unlock()
+	return nil
+}
+
+// refreshLoop keeps the allocation, the permissions and the
+// channels alive until the conn is closed
+func (conn *TurnConn) refreshLoop() {
+	ticker := time.NewTicker(TURN_REFRESH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.closed:
+			return
+		case <-ticker.C:
+		}
+
+		deadline := time.Now().Add(TURN_REFRESH_MARGIN)
+		var peers []*net.UDPAddr
+		var chans []*turnChannel
+		conn.mutex.Lock()
+		refresh := conn.expire.Before(deadline)
+		for ip, expire := range conn.perms {
+			if expire.Before(deadline) {
+				peers = append(peers, &net.UDPAddr{IP: net.ParseIP(ip)})
+			}
+		}
+		for _, ch := range conn.chans {
+			if ch.expire.Before(deadline) {
+				chans = append(chans, ch)
+			}
+		}
+		conn.mutex.Unlock()
+
+		if refresh {
+			if rmsg, err := conn.request(STUN_METHOD_REFRESH); err != nil {
+				debug("turn: refresh", err)
+			} else {
+				conn.mutex.Lock()
+				conn.expire = time.Now().Add(responseLifetime(rmsg))
+				conn.mutex.Unlock()
+			}
+		}
+		if len(peers) > 0 {
+			if err := conn.CreatePermission(peers...); err != nil {
+				debug("turn: create permission", err)
+			}
+		}
+		for _, ch := range chans {
+			if err := conn.channelBind(ch); err != nil {
+				debug("turn: channel bind", err)
+			}
+		}
+	}
+}
+
+// Close deletes the allocation and closes the client. The Refresh
+// deleting the allocation is sent once without waiting for the
+// response, if it is lost the allocation expires anyway.
+func (conn *TurnConn) Close() error {
+	conn.mutex.Lock()
+	select {
+	case <-conn.closed:
+		conn.mutex.Unlock()
+		return nil
+	default:
+		close(conn.closed)
+	}
+	conn.mutex.Unlock()
+
+	msg, key := conn.message(STUN_METHOD_REFRESH, NewStunAttr(STUN_ATTR_LIFETIME, uint32(0)))
+	if data, err := msg.Encode(nil, key, false, PADDING_BYTE); err == nil {
+		conn.client.write(data, nil)
+	}
+	return conn.client.Close()
+}
+
+// LocalAddr returns the relayed transport address
+func (conn *TurnConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: conn.relayed.IP, Port: conn.relayed.Port}
+}
+
+// RelayedAddr returns XOR-RELAYED-ADDRESS of the allocation
+func (conn *TurnConn) RelayedAddr() *StunAddr {
+	return conn.relayed
+}
+
+// MappedAddr returns XOR-MAPPED-ADDRESS of the allocation
+func (conn *TurnConn) MappedAddr() *StunAddr {
+	return conn.mapped
+}
+
+func (conn *TurnConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of ReadFrom, the calls
+// waiting already take it as well
+func (conn *TurnConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	conn.deadline = t
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+	conn.mutex.Unlock()
+	return nil
+}
+
+func (conn *TurnConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,149 @@
+package instun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// startAuthTurn serves a TURN relay which authenticates with the
+// long-term credentials of user, on network, and returns its address
+func startAuthTurn(t *testing.T, network string) (*Stun, string) {
+	stun := &Stun{Turn: NewTurnServer(loopback), LongTerm: turnCredentials()}
+	t.Cleanup(func() { stun.Shutdown(context.Background()) })
+
+	if network == "tcp4" {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go stun.Run(listener)
+		return stun, listener.Addr().String()
+	}
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go stun.RunUDP(udp)
+	return stun, udp.LocalAddr().String()
+}
+
+func readTurn(t *testing.T, conn *TurnConn) (string, net.Addr) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buff := make([]byte, MAX_PACKET_SIZE)
+	n, from, err := conn.ReadFrom(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buff[:n]), from
+}
+
+func TestTurnConn(t *testing.T) {
+	for _, network := range []string{"udp4", "tcp4"} {
+		stun, address := startAuthTurn(t, network)
+		conn, err := DialTurn(network, address, "user", "pass")
+		if err != nil {
+			t.Fatal(network, err)
+		}
+		peer := listenPeer(t)
+		relayed := conn.LocalAddr().(*net.UDPAddr)
+		assert(t, relayed.IP.Equal(loopback), "relayed address error!")
+
+		// Send and Data indications, the first write permits the peer
+		conn.WriteTo([]byte("hello"), peer.LocalAddr())
+		data, from := readPeer(t, peer)
+		assert(t, string(data) == "hello" && from.Port == relayed.Port, "sent data error!")
+		peer.WriteToUDP([]byte("world"), relayed)
+		payload, source := readTurn(t, conn)
+		assert(t, payload == "world" && source.String() == peer.LocalAddr().String(),
+			"data indication error!")
+
+		// ChannelData once a channel is bound
+		number, err := conn.BindChannel(peer.LocalAddr())
+		assert(t, err == nil && number == CHANNEL_MIN, "channel bind error!")
+		conn.WriteTo([]byte("abcde"), peer.LocalAddr())
+		data, _ = readPeer(t, peer)
+		assert(t, string(data) == "abcde", "channel data error!")
+		peer.WriteToUDP([]byte("fghij"), relayed)
+		payload, source = readTurn(t, conn)
+		assert(t, payload == "fghij" && source.String() == peer.LocalAddr().String(),
+			"relayed channel data error!")
+
+		// Close deletes the allocation right away
+		start := time.Now()
+		assert(t, conn.Close() == nil, "close error!")
+		assert(t, time.Since(start) < time.Second, "close blocks!")
+		assert(t, released(relayed), "allocation not deleted!")
+		stun.Turn.mutex.Lock()
+		assert(t, len(stun.Turn.allocs) == 0, "allocation left!")
+		stun.Turn.mutex.Unlock()
+
+		_, _, err = conn.ReadFrom(make([]byte, 1))
+		assert(t, errors.Is(err, net.ErrClosed), "read after close!")
+		_, err = conn.WriteTo([]byte("x"), peer.LocalAddr())
+		assert(t, errors.Is(err, net.ErrClosed), "write after close!")
+	}
+}
+
+func TestTurnConn_WrongPassword(t *testing.T) {
+	_, address := startAuthTurn(t, "udp4")
+	_, err := DialTurn("udp4", address, "user", "wrong")
+	ec, ok := err.(*ErrorCode)
+	assert(t, ok && ec.Code == 401, "wrong password passed!")
+}
+
+func TestTurnConn_ReadDeadline(t *testing.T) {
+	_, address := startAuthTurn(t, "udp4")
+	conn, err := DialTurn("udp4", address, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A deadline set while ReadFrom waits wakes it
+	read := make(chan error, 1)
+	go func () {
+		_, _, err := conn.ReadFrom(make([]byte, MAX_PACKET_SIZE))
+		read <- err
+	} ()
+	time.Sleep(20 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	select {
+	case err := <-read:
+		assert(t, errors.Is(err, os.ErrDeadlineExceeded), "deadline error!")
+	case <-time.After(time.Second):
+		t.Fatal("deadline doesn't wake ReadFrom")
+	}
+
+	// And so does a deadline in the past
+	conn.SetReadDeadline(time.Time{})
+	go func () {
+		_, _, err := conn.ReadFrom(make([]byte, MAX_PACKET_SIZE))
+		read <- err
+	} ()
+	time.Sleep(20 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	select {
+	case err := <-read:
+		assert(t, errors.Is(err, os.ErrDeadlineExceeded), "past deadline error!")
+	case <-time.After(time.Second):
+		t.Fatal("past deadline doesn't wake ReadFrom")
+	}
+}
+
+func TestTurnConn_CloseUnanswered(t *testing.T) {
+	stun, address := startAuthTurn(t, "udp4")
+	conn, err := DialTurn("udp4", address, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing answers the Refresh
+	stun.Shutdown(context.Background())
+	start := time.Now()
+	conn.Close()
+	assert(t, time.Since(start) < time.Second, "close waits for the response!")
+}